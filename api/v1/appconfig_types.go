@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -30,10 +31,251 @@ type AppService struct {
 }
 
 type DeployConfig struct {
-	Name     string     `json:"name"`
-	Image    string     `json:"image"`
-	Replicas *int32     `json:"replicas"`
-	Type     DeployType `json:"type"`
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	// Replicas 副本数，默认 1
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// ReplicasPercent canary 的副本数按 stable 副本数的百分比计算，向上取整且至少为 1，设置后忽略 Replicas
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	ReplicasPercent *int32     `json:"replicasPercent,omitempty"`
+	Type            DeployType `json:"type"`
+	// WorkloadKind 工作负载类型，默认 Deployment
+	// +kubebuilder:validation:Enum=Deployment;StatefulSet
+	// +optional
+	WorkloadKind WorkloadKind `json:"workloadKind,omitempty"`
+	// VolumeClaimTemplates StatefulSet 的存储卷模板，自动挂载到 app 容器，创建后不允许修改
+	// +optional
+	VolumeClaimTemplates []VolumeClaimTemplate `json:"volumeClaimTemplates,omitempty"`
+	// ImageWatch 定时拉取仓库的 tag 列表，自动把镜像更新为最新的 tag，只支持 canary
+	// +optional
+	ImageWatch *ImageWatch `json:"imageWatch,omitempty"`
+	// Env app 容器的环境变量，覆盖 AppConfig 中的同名变量
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// EnvFrom app 容器从 ConfigMap/Secret 导入的环境变量，追加在 AppConfig 的之后
+	// +optional
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+	// ConfigFiles 覆盖 AppConfig 的配置文件
+	// +optional
+	ConfigFiles *ConfigFiles `json:"configFiles,omitempty"`
+	// ContainerConfig app 容器的健康检查、资源和生命周期，覆盖 AppConfig 中的同名字段
+	ContainerConfig `json:",inline"`
+}
+
+// ContainerConfig app 容器的健康检查、资源和生命周期配置，设置后覆盖模板和 deployment-config 注解中的配置
+type ContainerConfig struct {
+	// +optional
+	LivenessProbe *corev1.Probe `json:"livenessProbe,omitempty"`
+	// +optional
+	ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+	// +optional
+	StartupProbe *corev1.Probe `json:"startupProbe,omitempty"`
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// +optional
+	Lifecycle *corev1.Lifecycle `json:"lifecycle,omitempty"`
+}
+
+// ConfigFiles 应用配置文件，渲染为不可变的 ConfigMap <appConfig>-config-<hash> 并挂载到 app 容器
+type ConfigFiles struct {
+	// MountPath 挂载到 app 容器的目录
+	MountPath string `json:"mountPath"`
+	// Files 文件名到文件内容
+	Files map[string]string `json:"files"`
+	// RevisionHistoryLimit 保留的历史版本数量，默认 5，工作负载正在使用的版本不会被删除
+	// +optional
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+}
+
+// GetRevisionHistoryLimit 返回保留的历史版本数量，默认 5
+func (c *ConfigFiles) GetRevisionHistoryLimit() int {
+	if c.RevisionHistoryLimit == nil {
+		return 5
+	}
+	return int(*c.RevisionHistoryLimit)
+}
+
+// VolumeClaimTemplate StatefulSet 存储卷模板
+type VolumeClaimTemplate struct {
+	Name      string                           `json:"name"`
+	MountPath string                           `json:"mountPath"`
+	Spec      corev1.PersistentVolumeClaimSpec `json:"spec"`
+}
+
+// GetReplicas 返回设置的副本数，没有设置时默认 1
+func (dc *DeployConfig) GetReplicas() int32 {
+	if dc.Replicas == nil {
+		return 1
+	}
+	return *dc.Replicas
+}
+
+// GetDesiredReplicas 返回 deployConfig 期望的副本数，canary 设置 ReplicasPercent 时按 stable 的百分比计算
+func (r *AppConfig) GetDesiredReplicas(dc *DeployConfig) int32 {
+	if dc.Type != CanaryDeploy || dc.ReplicasPercent == nil {
+		return dc.GetReplicas()
+	}
+	stableReplicas := int32(1)
+	if stable, ok := r.GetDeployConfig(StableDeploy); ok {
+		stableReplicas = stable.GetReplicas()
+	}
+	replicas := (stableReplicas**dc.ReplicasPercent + 99) / 100
+	if replicas < 1 {
+		return 1
+	}
+	return replicas
+}
+
+// GetWorkloadKind 返回工作负载类型，没有设置时默认 Deployment
+func (dc *DeployConfig) GetWorkloadKind() WorkloadKind {
+	if dc.WorkloadKind == NilValue {
+		return DeploymentWorkload
+	}
+	return dc.WorkloadKind
+}
+
+// GetDeployConfig 返回指定类型的 deployConfig
+func (r *AppConfig) GetDeployConfig(t DeployType) (DeployConfig, bool) {
+	for _, dc := range r.Spec.DeployConfigs {
+		if dc.Type == t {
+			return dc, true
+		}
+	}
+	return DeployConfig{}, false
+}
+
+// GetEnv 返回 deployConfig 的 app 容器环境变量，deployConfig 中的同名变量优先
+func (r *AppConfig) GetEnv(dc *DeployConfig) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for _, e := range r.Spec.Env {
+		if !containsEnv(dc.Env, e.Name) {
+			env = append(env, e)
+		}
+	}
+	return append(env, dc.Env...)
+}
+
+// GetConfigFiles 返回 deployConfig 的配置文件，deployConfig 中的配置优先
+func (r *AppConfig) GetConfigFiles(dc *DeployConfig) *ConfigFiles {
+	if dc.ConfigFiles != nil {
+		return dc.ConfigFiles
+	}
+	return r.Spec.ConfigFiles
+}
+
+// GetContainerConfig 返回 deployConfig 的 app 容器配置，deployConfig 中设置的字段优先
+func (r *AppConfig) GetContainerConfig(dc *DeployConfig) ContainerConfig {
+	cc := r.Spec.ContainerConfig
+	if dc.LivenessProbe != nil {
+		cc.LivenessProbe = dc.LivenessProbe
+	}
+	if dc.ReadinessProbe != nil {
+		cc.ReadinessProbe = dc.ReadinessProbe
+	}
+	if dc.StartupProbe != nil {
+		cc.StartupProbe = dc.StartupProbe
+	}
+	if dc.Resources != nil {
+		cc.Resources = dc.Resources
+	}
+	if dc.Lifecycle != nil {
+		cc.Lifecycle = dc.Lifecycle
+	}
+	return cc
+}
+
+// GetEnvFrom 返回 deployConfig 的 app 容器 envFrom
+func (r *AppConfig) GetEnvFrom(dc *DeployConfig) []corev1.EnvFromSource {
+	var envFrom []corev1.EnvFromSource
+	envFrom = append(envFrom, r.Spec.EnvFrom...)
+	return append(envFrom, dc.EnvFrom...)
+}
+
+func containsEnv(env []corev1.EnvVar, name string) bool {
+	for _, e := range env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageWatch 镜像自动更新配置，SemverRange 和 TagPattern 至少设置一个
+type ImageWatch struct {
+	// SemverRange 语义化版本范围，例如 >=1.2.0 <2.0.0，选择范围内最大的版本
+	// +optional
+	SemverRange string `json:"semverRange,omitempty"`
+	// TagPattern tag 正则过滤，没有 SemverRange 时按语义化版本或字母顺序选择最大的 tag
+	// +optional
+	TagPattern string `json:"tagPattern,omitempty"`
+	// Interval 拉取间隔，默认 5m，最小 1m
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// FreezeWindow 发布冻结窗口，窗口内镜像变更会被挂起，状态照常更新
+// Schedule 和 Start/End 二选一
+type FreezeWindow struct {
+	// Schedule 标准 cron 表达式，表示窗口的开始时间，支持 CRON_TZ= 前缀指定时区
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+	// Duration 配合 Schedule 使用，表示窗口持续时间，例如 48h
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+	// Start 固定时间段的开始时间
+	// +optional
+	Start *metav1.Time `json:"start,omitempty"`
+	// End 固定时间段的结束时间
+	// +optional
+	End *metav1.Time `json:"end,omitempty"`
+}
+
+type MirrorProvider string
+
+const (
+	// NginxMirror 通过 stable ingress 的 nginx mirror-target 注解复制请求
+	NginxMirror MirrorProvider = "nginx"
+	// GatewayMirror 通过 HTTPRoute 的 RequestMirror 过滤器复制请求
+	GatewayMirror MirrorProvider = "gateway"
+)
+
+// TrafficMirror 把发往 stable 的请求复制到 canary service，canary 的响应会被丢弃
+type TrafficMirror struct {
+	Enable bool `json:"enable"`
+	// Provider 流量复制的实现方式，默认 nginx
+	// +kubebuilder:validation:Enum=nginx;gateway
+	// +optional
+	Provider MirrorProvider `json:"provider,omitempty"`
+	// Percent 复制的请求百分比，默认 100，只有 gateway 支持小于 100
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	Percent *int32 `json:"percent,omitempty"`
+	// GatewayName provider 为 gateway 时 HTTPRoute 关联的 Gateway
+	// +optional
+	GatewayName string `json:"gatewayName,omitempty"`
+	// GatewayNamespace Gateway 所在的命名空间，默认和 AppConfig 相同
+	// +optional
+	GatewayNamespace string `json:"gatewayNamespace,omitempty"`
+}
+
+// GetProvider 返回流量复制的实现方式，默认 nginx
+func (m *TrafficMirror) GetProvider() MirrorProvider {
+	if m.Provider == NilValue {
+		return NginxMirror
+	}
+	return m.Provider
+}
+
+// GetPercent 返回复制的请求百分比，默认 100
+func (m *TrafficMirror) GetPercent() int32 {
+	if m.Percent == nil {
+		return 100
+	}
+	return *m.Percent
 }
 
 type AppIngress struct {
@@ -41,6 +283,51 @@ type AppIngress struct {
 	Host   string `json:"host"`
 }
 
+// BatchJob 和应用使用相同镜像的定时任务，镜像跟随 stable
+type BatchJob struct {
+	// Name 任务名称，CronJob 名称为 <appConfig>-<name>
+	Name string `json:"name"`
+	// Schedule cron 表达式
+	Schedule string `json:"schedule"`
+	// +optional
+	Command []string `json:"command,omitempty"`
+	// +optional
+	Args []string `json:"args,omitempty"`
+	// +kubebuilder:validation:Enum=Allow;Forbid;Replace
+	// +optional
+	ConcurrencyPolicy batchv1.ConcurrencyPolicy `json:"concurrencyPolicy,omitempty"`
+	// +optional
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit,omitempty"`
+	// +optional
+	FailedJobsHistoryLimit *int32 `json:"failedJobsHistoryLimit,omitempty"`
+	// +optional
+	Suspend *bool `json:"suspend,omitempty"`
+}
+
+type HookPhase string
+
+const (
+	// PreHook stable 更新前执行，成功后才允许更新 stable
+	PreHook HookPhase = "pre"
+	// PostHook stable 发布完成后执行
+	PostHook HookPhase = "post"
+)
+
+// Hook 每个新的 stable 镜像版本执行一次的 Job，例如数据库迁移和冒烟测试
+type Hook struct {
+	Name string `json:"name"`
+	// +kubebuilder:validation:Enum=pre;post
+	Phase HookPhase `json:"phase"`
+	// Container 执行的容器，没有设置镜像时使用 stable 的镜像
+	Container corev1.Container `json:"container"`
+	// Timeout 超时时间，超时后 hook 失败
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// BackoffLimit 失败重试次数，默认 0
+	// +optional
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+}
+
 // AppConfigSpec defines the desired state of AppConfig
 type AppConfigSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
@@ -51,13 +338,122 @@ type AppConfigSpec struct {
 	Service       AppService     `json:"service,omitempty"`
 	DeployConfigs []DeployConfig `json:"deployConfigs"`
 	Paused        bool           `json:"paused,omitempty"`
+	// FreezeWindows 发布冻结窗口
+	// +optional
+	FreezeWindows []FreezeWindow `json:"freezeWindows,omitempty"`
+	// BatchJobs 定时任务，渲染为 CronJob
+	// +optional
+	BatchJobs []BatchJob `json:"batchJobs,omitempty"`
+	// Hooks stable 发布前后执行的 Job
+	// +optional
+	Hooks []Hook `json:"hooks,omitempty"`
+	// Env 所有 deployConfig 的 app 容器环境变量，引用的 ConfigMap/Secret 内容变化时触发滚动更新
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// EnvFrom 所有 deployConfig 的 app 容器从 ConfigMap/Secret 导入的环境变量
+	// +optional
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+	// ConfigFiles 所有 deployConfig 的配置文件，内容变化时生成新的 ConfigMap 并滚动更新
+	// +optional
+	ConfigFiles *ConfigFiles `json:"configFiles,omitempty"`
+	// ContainerConfig 所有 deployConfig 的 app 容器默认的健康检查、资源和生命周期
+	ContainerConfig `json:",inline"`
+	// Mirror 在切换真实流量之前把 stable 的请求复制到 canary
+	// +optional
+	Mirror *TrafficMirror `json:"mirror,omitempty"`
 }
 
 type DeployStatus struct {
 	AvailableStatus   corev1.ConditionStatus `json:"availableStatus"`
 	ProgressingStatus corev1.ConditionStatus `json:"progressingStatus"`
 	AvailableReplicas int32                  `json:"availableReplicas"`
-	Type              DeployType             `json:"type"`
+	// DesiredReplicas 期望的副本数，canary 按百分比计算时为计算后的值
+	DesiredReplicas int32 `json:"desiredReplicas,omitempty"`
+	// Idle canary 处于空闲状态，已缩容到 0
+	Idle bool       `json:"idle,omitempty"`
+	Type DeployType `json:"type"`
+	// WorkloadKind 工作负载类型
+	WorkloadKind WorkloadKind `json:"workloadKind,omitempty"`
+	// Image 当前工作负载中 app 容器的镜像
+	Image string `json:"image,omitempty"`
+	// PendingImage 冻结窗口内被挂起的镜像
+	PendingImage string `json:"pendingImage,omitempty"`
+}
+
+type MirrorStatus struct {
+	Provider MirrorProvider `json:"provider"`
+	// Active 是否正在复制流量，canary 没有可用副本时不复制
+	Active bool `json:"active"`
+	// Target 接收复制流量的 canary service
+	Target string `json:"target,omitempty"`
+	// Percent 复制的请求百分比
+	Percent int32 `json:"percent,omitempty"`
+	// HTTPRoute provider 为 gateway 时管理的 HTTPRoute 名称
+	HTTPRoute string `json:"httpRoute,omitempty"`
+}
+
+type Action string
+
+const (
+	// PromoteAction 把 stable 的镜像更新为 canary 的镜像
+	PromoteAction Action = "promote"
+	// AbortAction 把 canary 的镜像回滚为 stable 的镜像
+	AbortAction Action = "abort"
+	// RetryAction 重新执行当前 stable 版本失败的 hook 并重新调谐
+	RetryAction Action = "retry"
+	// SkipAnalysisAction 严格发布模式下不再等待当前版本的 canary 可用
+	SkipAnalysisAction Action = "skip-analysis"
+)
+
+// Actions 支持的手动发布操作
+var Actions = []Action{PromoteAction, AbortAction, RetryAction, SkipAnalysisAction}
+
+// IsValid 是否是支持的操作
+func (a Action) IsValid() bool {
+	for _, action := range Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// ActionRecord 手动发布操作的审计记录
+type ActionRecord struct {
+	Action Action `json:"action"`
+	// User 执行人
+	User string      `json:"user"`
+	Time metav1.Time `json:"time"`
+	// Succeeded 是否执行成功
+	Succeeded bool   `json:"succeeded"`
+	Message   string `json:"message,omitempty"`
+}
+
+type ImageWatchStatus struct {
+	// Name deployConfig 名称
+	Name string `json:"name"`
+	// LastSeenTag 最近一次拉取到的最新 tag
+	LastSeenTag string `json:"lastSeenTag,omitempty"`
+	// LastPollTime 最近一次拉取的时间
+	LastPollTime *metav1.Time `json:"lastPollTime,omitempty"`
+}
+
+type HookResult string
+
+const (
+	HookRunning   HookResult = "Running"
+	HookSucceeded HookResult = "Succeeded"
+	HookFailed    HookResult = "Failed"
+)
+
+type HookStatus struct {
+	Name  string    `json:"name"`
+	Phase HookPhase `json:"phase"`
+	// Image hook 对应的 stable 镜像版本
+	Image string `json:"image"`
+	// Job 执行 hook 的 Job 名称
+	Job    string     `json:"job"`
+	Result HookResult `json:"result"`
 }
 
 // AppConfigStatus defines the observed state of AppConfig
@@ -66,6 +462,31 @@ type AppConfigStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	DeployStatus      []DeployStatus `json:"deployStatus"`
 	AvailableReplicas int32          `json:"availableReplicas"`
+	// Hooks 当前 stable 镜像版本的 hook 执行状态
+	// +optional
+	Hooks []HookStatus `json:"hooks,omitempty"`
+	// ImageWatch 镜像自动更新的状态
+	// +optional
+	ImageWatch []ImageWatchStatus `json:"imageWatch,omitempty"`
+	// ImageDigests 开启 resolve-digest 后镜像 tag 到 digest 的映射
+	// +optional
+	ImageDigests map[string]string `json:"imageDigests,omitempty"`
+	// Mirror 流量复制的状态
+	// +optional
+	Mirror *MirrorStatus `json:"mirror,omitempty"`
+	// Actions 最近的手动发布操作记录，按时间顺序保留最近 10 条
+	// +optional
+	Actions []ActionRecord `json:"actions,omitempty"`
+	// SkipAnalysisImage 执行 skip-analysis 时 canary 的镜像，canary 为该镜像时 stable 不再等待 canary 可用
+	// +optional
+	SkipAnalysisImage string `json:"skipAnalysisImage,omitempty"`
+	// FrozenUntil 当前冻结窗口的结束时间，挂起的镜像将在此之后发布
+	// +optional
+	FrozenUntil *metav1.Time `json:"frozenUntil,omitempty"`
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -17,28 +17,98 @@ limitations under the License.
 package v1
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
 	apierr "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
+	"os"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strings"
+	"time"
 )
 
 // log is for logging in this package.
 var acLog = logf.Log.WithName("appconfig-resource")
 
+// policyReader 用于在 webhook 中读取命名空间的 AppPolicy
+var policyReader client.Reader
+
+// operatorUser operator 自己的用户名，发布操作 API 代替请求的用户设置 action-by 注解，没有设置环境变量时为空
+var operatorUser = getOperatorUser(os.Getenv("POD_NAMESPACE"), os.Getenv("SERVICE_ACCOUNT_NAME"))
+
+func getOperatorUser(namespace, name string) string {
+	if namespace == NilValue || name == NilValue {
+		return NilValue
+	}
+	return "system:serviceaccount:" + namespace + ":" + name
+}
+
 func (r *AppConfig) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	policyReader = mgr.GetClient()
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
+		WithDefaulter(&appConfigDefaulter{}).
 		Complete()
 }
 
 //+kubebuilder:webhook:path=/mutate-app-sanmuyan-com-v1-appconfig,mutating=true,failurePolicy=fail,sideEffects=None,groups=app.sanmuyan.com,resources=appconfigs,verbs=create;update,versions=v1,name=mappconfig.kb.io,admissionReviewVersions=v1
 
+// appConfigDefaulter 在 Default 的基础上使用请求的用户设置 action-by 注解
+type appConfigDefaulter struct{}
+
+var _ webhook.CustomDefaulter = &appConfigDefaulter{}
+
+func (d *appConfigDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	ac, ok := obj.(*AppConfig)
+	if !ok {
+		return fmt.Errorf("expected an AppConfig but got a %T", obj)
+	}
+	ac.Default()
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	old := &AppConfig{}
+	if len(req.OldObject.Raw) > 0 {
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return err
+		}
+	}
+	ac.setActionBy(req.UserInfo.Username, old)
+	return nil
+}
+
+// setActionBy action 注解变化时把 action-by 设置为请求的用户，客户端设置的 action-by 被忽略，
+// operator 自己的请求（发布操作 API 和 controller）保留 action-by
+func (r *AppConfig) setActionBy(user string, old *AppConfig) {
+	if operatorUser != NilValue && user == operatorUser {
+		return
+	}
+	key := LabelPrefix + "/" + ActionByAnnotation
+	action := GetAnnotation(r, ActionAnnotation)
+	switch {
+	case action == NilValue:
+		delete(r.Annotations, key)
+	case action != GetAnnotation(old, ActionAnnotation):
+		AddAnnotation(r, ActionByAnnotation, user)
+	case GetAnnotation(old, ActionByAnnotation) != NilValue:
+		AddAnnotation(r, ActionByAnnotation, GetAnnotation(old, ActionByAnnotation))
+	default:
+		delete(r.Annotations, key)
+	}
+}
+
 var _ webhook.Defaulter = &AppConfig{}
 
 // Default implements webhook.Defaulter so a webhook will be registered for the type
@@ -47,7 +117,23 @@ func (r *AppConfig) Default() {
 
 	for i := range r.Spec.DeployConfigs {
 		r.Spec.DeployConfigs[i].Name = r.Name + "-" + string(r.Spec.DeployConfigs[i].Type)
+		r.Spec.DeployConfigs[i].WorkloadKind = r.Spec.DeployConfigs[i].GetWorkloadKind()
 	}
+
+	// 应用命名空间的 AppPolicy
+	policies, err := r.listAppPolicies()
+	if err != nil {
+		acLog.Info("failed to list appPolicy", "namespace", r.Namespace, "name", r.Name, "error", err)
+		return
+	}
+	ApplyAppPolicies(r, policies)
+}
+
+func (r *AppConfig) listAppPolicies() ([]AppPolicy, error) {
+	if policyReader == nil {
+		return nil, nil
+	}
+	return ListAppPolicies(context.Background(), policyReader, r.Namespace)
 }
 
 //+kubebuilder:webhook:path=/validate-app-sanmuyan-com-v1-appconfig,mutating=false,failurePolicy=fail,sideEffects=None,groups=app.sanmuyan.com,resources=appconfigs,verbs=create;update,versions=v1,name=vappconfig.kb.io,admissionReviewVersions=v1
@@ -58,6 +144,14 @@ var _ webhook.Validator = &AppConfig{}
 func (r *AppConfig) ValidateCreate() (admission.Warnings, error) {
 	acLog.Info("validate create", "name", r.Name)
 
+	errList, err := r.validate()
+	if err != nil {
+		return nil, err
+	}
+	if len(errList) > 0 {
+		return nil, apierr.NewInvalid(
+			schema.GroupKind{Group: "app.sanmuyan.com", Kind: "AppConfig"}, r.Name, errList)
+	}
 	return nil, nil
 }
 
@@ -68,20 +162,277 @@ func (r *AppConfig) ValidateUpdate(old runtime.Object) (admission.Warnings, erro
 	var errList field.ErrorList
 	if !controllerutil.ContainsFinalizer(r, AppConfigFinalizer) {
 		if GetAnnotation(r, ProtectedAnnotation) == TureValue {
-			errList = append(errList, field.Invalid(field.NewPath("annotations"), ProtectedAnnotation, DeleteProtectedMessage))
+			errList = append(errList, field.Invalid(field.NewPath("metadata", "annotations"), ProtectedAnnotation, DeleteProtectedMessage))
 			return nil, apierr.NewInvalid(
 				schema.GroupKind{Group: "app.sanmuyan.com", Kind: "AppConfig"}, r.Name, errList)
 		}
 	}
 
-	for _, dc := range r.Spec.DeployConfigs {
+	// 删除中的对象只会移除 finalizer，不再校验，避免收紧策略后无法删除
+	if !r.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	policies, err := r.listAppPolicies()
+	if err != nil {
+		return nil, err
+	}
+	errList = r.validateSpec()
+	policyErrList := ValidateAppPolicies(r, policies)
+	if oldAC, ok := old.(*AppConfig); ok {
+		// 只拒绝本次修改的字段，更新前已经违反策略的字段不影响元数据和其他字段的修改
+		policyErrList = subtractErrors(policyErrList, ValidateAppPolicies(oldAC, policies))
+	}
+	errList = append(errList, policyErrList...)
+	if len(errList) > 0 {
+		return nil, apierr.NewInvalid(
+			schema.GroupKind{Group: "app.sanmuyan.com", Kind: "AppConfig"}, r.Name, errList)
+	}
+	return nil, nil
+}
+
+// validate 校验字段和命名空间的 AppPolicy 约束
+func (r *AppConfig) validate() (field.ErrorList, error) {
+	errList := r.validateSpec()
+	policies, err := r.listAppPolicies()
+	if err != nil {
+		return nil, err
+	}
+	return append(errList, ValidateAppPolicies(r, policies)...), nil
+}
+
+// subtractErrors 返回 errList 中不在 existing 里的错误
+func subtractErrors(errList, existing field.ErrorList) field.ErrorList {
+	seen := make(map[string]bool, len(existing))
+	for _, e := range existing {
+		seen[e.Error()] = true
+	}
+	var result field.ErrorList
+	for _, e := range errList {
+		if !seen[e.Error()] {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// validateSpec 创建和更新共用的字段校验
+func (r *AppConfig) validateSpec() field.ErrorList {
+	var errList field.ErrorList
+	specPath := field.NewPath("spec")
+	for i, dc := range r.Spec.DeployConfigs {
 		if dc.Type != StableDeploy && dc.Type != CanaryDeploy {
-			errList = append(errList, field.Invalid(field.NewPath("spec", "deployConfigs", "type"), dc.Type, "invalid type"))
-			return nil, apierr.NewInvalid(
-				schema.GroupKind{Group: "app.sanmuyan.com", Kind: "AppConfig"}, r.Name, errList)
+			errList = append(errList, field.Invalid(specPath.Child("deployConfigs").Index(i).Child("type"), dc.Type, "invalid type"))
+		}
+		if len(dc.VolumeClaimTemplates) > 0 && dc.GetWorkloadKind() != StatefulSetWorkload {
+			errList = append(errList, field.Forbidden(specPath.Child("deployConfigs").Index(i).Child("volumeClaimTemplates"), "volumeClaimTemplates is only supported on StatefulSet"))
+		}
+		for j, vct := range dc.VolumeClaimTemplates {
+			if vct.MountPath == NilValue {
+				errList = append(errList, field.Required(specPath.Child("deployConfigs").Index(i).Child("volumeClaimTemplates").Index(j).Child("mountPath"), "mountPath is required"))
+			}
+		}
+		if dc.ReplicasPercent != nil && dc.Type != CanaryDeploy {
+			errList = append(errList, field.Forbidden(specPath.Child("deployConfigs").Index(i).Child("replicasPercent"), "replicasPercent is only supported on canary"))
+		}
+		errList = append(errList, validateContainerConfig(specPath.Child("deployConfigs").Index(i), &dc.ContainerConfig)...)
+		if dc.ConfigFiles != nil {
+			errList = append(errList, validateConfigFiles(specPath.Child("deployConfigs").Index(i).Child("configFiles"), dc.ConfigFiles)...)
+		}
+		if dc.ImageWatch != nil {
+			watchPath := specPath.Child("deployConfigs").Index(i).Child("imageWatch")
+			if dc.Type != CanaryDeploy {
+				errList = append(errList, field.Forbidden(watchPath, "imageWatch is only supported on canary"))
+			} else if err := dc.ImageWatch.Validate(); err != nil {
+				errList = append(errList, field.Invalid(watchPath, dc.ImageWatch, err.Error()))
+			}
 		}
 	}
-	return nil, nil
+	errList = append(errList, validateContainerConfig(specPath, &r.Spec.ContainerConfig)...)
+	if action := GetAnnotation(r, ActionAnnotation); action != NilValue && !Action(action).IsValid() {
+		supported := make([]string, 0, len(Actions))
+		for _, a := range Actions {
+			supported = append(supported, string(a))
+		}
+		errList = append(errList, field.NotSupported(field.NewPath("metadata", "annotations").Key(LabelPrefix+"/"+ActionAnnotation), action, supported))
+	}
+	if r.Spec.Mirror != nil {
+		errList = append(errList, r.validateMirror(specPath.Child("mirror"))...)
+	}
+	if r.Spec.ConfigFiles != nil {
+		errList = append(errList, validateConfigFiles(specPath.Child("configFiles"), r.Spec.ConfigFiles)...)
+	}
+	batchJobNames := make(map[string]bool)
+	for i, bj := range r.Spec.BatchJobs {
+		bjPath := specPath.Child("batchJobs").Index(i)
+		if bj.Name == NilValue {
+			errList = append(errList, field.Required(bjPath.Child("name"), "name is required"))
+		} else if batchJobNames[bj.Name] {
+			errList = append(errList, field.Duplicate(bjPath.Child("name"), bj.Name))
+		}
+		batchJobNames[bj.Name] = true
+		// CronJob 的 pod 使用 app: <appConfig>-<name> 标签，不能和 deployConfig 的 service selector 相同
+		for _, dc := range r.Spec.DeployConfigs {
+			if bj.Name != NilValue && (bj.Name == dc.Name || r.Name+"-"+bj.Name == dc.Name) {
+				errList = append(errList, field.Invalid(bjPath.Child("name"), bj.Name, "conflicts with deployConfig "+dc.Name))
+			}
+		}
+		if _, err := cron.ParseStandard(bj.Schedule); err != nil {
+			errList = append(errList, field.Invalid(bjPath.Child("schedule"), bj.Schedule, err.Error()))
+		}
+	}
+	if len(r.Spec.BatchJobs) > 0 {
+		if _, ok := r.GetDeployConfig(StableDeploy); !ok {
+			errList = append(errList, field.Required(specPath.Child("deployConfigs"), "batchJobs require a stable deployConfig"))
+		}
+	}
+	hookNames := make(map[string]bool)
+	for i, hook := range r.Spec.Hooks {
+		hookPath := specPath.Child("hooks").Index(i)
+		if hook.Name == NilValue {
+			errList = append(errList, field.Required(hookPath.Child("name"), "name is required"))
+		} else if hookNames[hook.Name] {
+			errList = append(errList, field.Duplicate(hookPath.Child("name"), hook.Name))
+		}
+		hookNames[hook.Name] = true
+		if hook.Phase != PreHook && hook.Phase != PostHook {
+			errList = append(errList, field.NotSupported(hookPath.Child("phase"), hook.Phase, []string{string(PreHook), string(PostHook)}))
+		}
+	}
+	if len(r.Spec.Hooks) > 0 {
+		if _, ok := r.GetDeployConfig(StableDeploy); !ok {
+			errList = append(errList, field.Required(specPath.Child("deployConfigs"), "hooks require a stable deployConfig"))
+		}
+	}
+	for i := range r.Spec.FreezeWindows {
+		w := &r.Spec.FreezeWindows[i]
+		if w.Schedule != NilValue && (w.Start != nil || w.End != nil) {
+			errList = append(errList, field.Invalid(specPath.Child("freezeWindows").Index(i), w.Schedule, "schedule and start/end are mutually exclusive"))
+			continue
+		}
+		if err := w.Validate(time.Now()); err != nil {
+			errList = append(errList, field.Invalid(specPath.Child("freezeWindows").Index(i), w.Schedule, err.Error()))
+		}
+	}
+	return errList
+}
+
+func validateConfigFiles(path *field.Path, cf *ConfigFiles) field.ErrorList {
+	var errList field.ErrorList
+	if !strings.HasPrefix(cf.MountPath, "/") {
+		errList = append(errList, field.Invalid(path.Child("mountPath"), cf.MountPath, "must be an absolute path"))
+	}
+	if len(cf.Files) == 0 {
+		errList = append(errList, field.Required(path.Child("files"), "files is required"))
+	}
+	for name := range cf.Files {
+		for _, msg := range validation.IsConfigMapKey(name) {
+			errList = append(errList, field.Invalid(path.Child("files").Key(name), name, msg))
+		}
+	}
+	if cf.RevisionHistoryLimit != nil && *cf.RevisionHistoryLimit < 0 {
+		errList = append(errList, field.Invalid(path.Child("revisionHistoryLimit"), *cf.RevisionHistoryLimit, "must be greater than or equal to 0"))
+	}
+	return errList
+}
+
+func (r *AppConfig) validateMirror(path *field.Path) field.ErrorList {
+	var errList field.ErrorList
+	m := r.Spec.Mirror
+	if _, ok := r.GetDeployConfig(CanaryDeploy); !ok {
+		errList = append(errList, field.Required(field.NewPath("spec", "deployConfigs"), "mirror requires a canary deployConfig"))
+	}
+	if !r.Spec.Service.Enable {
+		errList = append(errList, field.Required(field.NewPath("spec", "service", "enable"), "mirror requires service to be enabled"))
+	}
+	switch m.GetProvider() {
+	case NginxMirror:
+		if !r.Spec.Ingress.Enable {
+			errList = append(errList, field.Required(field.NewPath("spec", "ingress", "enable"), "nginx mirror requires ingress to be enabled"))
+		}
+		if m.GetPercent() != 100 {
+			errList = append(errList, field.Invalid(path.Child("percent"), m.GetPercent(), "percent is only supported by the gateway provider"))
+		}
+	case GatewayMirror:
+		if m.GatewayName == NilValue {
+			errList = append(errList, field.Required(path.Child("gatewayName"), "gatewayName is required by the gateway provider"))
+		}
+		// HTTPRoute 把 host 的流量全部路由到 stable，不支持按权重切换到 canary
+		if m.Enable && GetAnnotation(r, CanaryIngressAnnotation) == TureValue {
+			errList = append(errList, field.Forbidden(field.NewPath("metadata", "annotations").Key(LabelPrefix+"/"+CanaryIngressAnnotation),
+				"weighted canary traffic is not supported by the gateway mirror provider"))
+		}
+	}
+	return errList
+}
+
+func validateContainerConfig(path *field.Path, cc *ContainerConfig) field.ErrorList {
+	var errList field.ErrorList
+	errList = append(errList, validateProbe(path.Child("livenessProbe"), cc.LivenessProbe, true)...)
+	errList = append(errList, validateProbe(path.Child("readinessProbe"), cc.ReadinessProbe, false)...)
+	errList = append(errList, validateProbe(path.Child("startupProbe"), cc.StartupProbe, true)...)
+	if cc.Resources != nil {
+		for name, request := range cc.Resources.Requests {
+			if limit, ok := cc.Resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+				errList = append(errList, field.Invalid(path.Child("resources", "requests").Key(string(name)), request.String(), "must be less than or equal to the limit"))
+			}
+		}
+	}
+	if cc.Lifecycle != nil {
+		if h := cc.Lifecycle.PostStart; h != nil && countHandlers(h.Exec != nil, h.HTTPGet != nil, h.TCPSocket != nil) != 1 {
+			errList = append(errList, field.Invalid(path.Child("lifecycle", "postStart"), h, "must specify exactly one handler"))
+		}
+		if h := cc.Lifecycle.PreStop; h != nil && countHandlers(h.Exec != nil, h.HTTPGet != nil, h.TCPSocket != nil) != 1 {
+			errList = append(errList, field.Invalid(path.Child("lifecycle", "preStop"), h, "must specify exactly one handler"))
+		}
+	}
+	return errList
+}
+
+// validateProbe 检查探针的处理方式和数值，liveness 和 startup 的 successThreshold 只能是 1
+func validateProbe(path *field.Path, probe *corev1.Probe, singleSuccess bool) field.ErrorList {
+	var errList field.ErrorList
+	if probe == nil {
+		return errList
+	}
+	h := probe.ProbeHandler
+	if countHandlers(h.Exec != nil, h.HTTPGet != nil, h.TCPSocket != nil, h.GRPC != nil) != 1 {
+		errList = append(errList, field.Invalid(path, probe, "must specify exactly one handler"))
+	}
+	if h.HTTPGet != nil && h.HTTPGet.Port.IntValue() == 0 && h.HTTPGet.Port.StrVal == NilValue {
+		errList = append(errList, field.Required(path.Child("httpGet", "port"), "port is required"))
+	}
+	if h.TCPSocket != nil && h.TCPSocket.Port.IntValue() == 0 && h.TCPSocket.Port.StrVal == NilValue {
+		errList = append(errList, field.Required(path.Child("tcpSocket", "port"), "port is required"))
+	}
+	for _, v := range []struct {
+		name  string
+		value int32
+	}{
+		{"initialDelaySeconds", probe.InitialDelaySeconds},
+		{"timeoutSeconds", probe.TimeoutSeconds},
+		{"periodSeconds", probe.PeriodSeconds},
+		{"successThreshold", probe.SuccessThreshold},
+		{"failureThreshold", probe.FailureThreshold},
+	} {
+		if v.value < 0 {
+			errList = append(errList, field.Invalid(path.Child(v.name), v.value, "must be greater than or equal to 0"))
+		}
+	}
+	if singleSuccess && probe.SuccessThreshold > 1 {
+		errList = append(errList, field.Invalid(path.Child("successThreshold"), probe.SuccessThreshold, "must be 1"))
+	}
+	return errList
+}
+
+func countHandlers(handlers ...bool) int {
+	n := 0
+	for _, h := range handlers {
+		if h {
+			n++
+		}
+	}
+	return n
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
@@ -0,0 +1,189 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"testing"
+)
+
+func TestValidateUpdatePolicies(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	maxReplicas := int32(2)
+	policy := &AppPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "limits", Namespace: "default"},
+		Spec: AppPolicySpec{
+			MaxReplicas: &maxReplicas,
+			ImagePolicy: &ImagePolicy{DeniedTags: []string{"latest"}},
+		},
+	}
+	defer func(reader client.Reader) { policyReader = reader }(policyReader)
+	policyReader = fake.NewClientBuilder().WithScheme(scheme).WithObjects(policy).Build()
+
+	newAppConfig := func(replicas int32, image string) *AppConfig {
+		ac := &AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", Finalizers: []string{AppConfigFinalizer}}}
+		ac.Spec.DeployConfigs = []DeployConfig{{Name: "demo-stable", Type: StableDeploy, Image: image, Replicas: &replicas}}
+		return ac
+	}
+	deleting := newAppConfig(5, "app:v1")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	deleting.Finalizers = nil
+	percentCanary := func(stable, percent int32) *AppConfig {
+		ac := newAppConfig(stable, "app:v1")
+		ac.Spec.DeployConfigs = append(ac.Spec.DeployConfigs, DeployConfig{Name: "demo-canary", Type: CanaryDeploy, Image: "app:v1", ReplicasPercent: &percent})
+		return ac
+	}
+	annotated := newAppConfig(5, "app:v1")
+	AddAnnotation(annotated, ActionAnnotation, string(PromoteAction))
+
+	tests := []struct {
+		name    string
+		old     *AppConfig
+		new     *AppConfig
+		wantErr bool
+	}{
+		{name: "within policy", old: newAppConfig(1, "app:v1"), new: newAppConfig(2, "app:v2")},
+		{name: "replicas over max", old: newAppConfig(1, "app:v1"), new: newAppConfig(3, "app:v1"), wantErr: true},
+		{name: "canary percent within max", old: newAppConfig(1, "app:v1"), new: percentCanary(2, 100)},
+		{name: "canary percent over max", old: newAppConfig(5, "app:v1"), new: percentCanary(5, 50), wantErr: true},
+		{name: "denied tag", old: newAppConfig(1, "app:v1"), new: newAppConfig(1, "app:latest"), wantErr: true},
+		{name: "metadata change on violating object", old: newAppConfig(5, "app:v1"), new: annotated},
+		{name: "unchanged violation with other change", old: newAppConfig(5, "app:v1"), new: newAppConfig(5, "app:v2")},
+		{name: "new violation on violating object", old: newAppConfig(5, "app:v1"), new: newAppConfig(5, "app:latest"), wantErr: true},
+		{name: "deleting", old: newAppConfig(5, "app:v1"), new: deleting},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.new.ValidateUpdate(tt.old)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateMirror(t *testing.T) {
+	newAppConfig := func(provider MirrorProvider, canaryIngress bool) *AppConfig {
+		ac := &AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+		ac.Spec.DeployConfigs = []DeployConfig{
+			{Name: "demo-stable", Type: StableDeploy, Image: "app:v1"},
+			{Name: "demo-canary", Type: CanaryDeploy, Image: "app:v2"},
+		}
+		ac.Spec.Service.Enable = true
+		ac.Spec.Ingress.Enable = true
+		ac.Spec.Mirror = &TrafficMirror{Enable: true, Provider: provider, GatewayName: "gw"}
+		if canaryIngress {
+			AddAnnotation(ac, CanaryIngressAnnotation, TureValue)
+		}
+		return ac
+	}
+	disabled := newAppConfig(GatewayMirror, true)
+	disabled.Spec.Mirror.Enable = false
+	tests := []struct {
+		name    string
+		ac      *AppConfig
+		wantErr bool
+	}{
+		{name: "gateway", ac: newAppConfig(GatewayMirror, false)},
+		{name: "gateway with weighted canary", ac: newAppConfig(GatewayMirror, true), wantErr: true},
+		{name: "nginx with weighted canary", ac: newAppConfig(NginxMirror, true)},
+		{name: "disabled gateway with weighted canary", ac: disabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errList := tt.ac.validateSpec()
+			if (len(errList) > 0) != tt.wantErr {
+				t.Errorf("errors = %v, wantErr %v", errList, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateBatchJobName(t *testing.T) {
+	tests := []struct {
+		name    string
+		bjName  string
+		wantErr bool
+	}{
+		{name: "distinct", bjName: "cleanup"},
+		{name: "same as deployConfig", bjName: "demo-stable", wantErr: true},
+		{name: "label same as deployConfig", bjName: "stable", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+			ac.Spec.DeployConfigs = []DeployConfig{{Name: "demo-stable", Type: StableDeploy, Image: "app:v1"}}
+			ac.Spec.BatchJobs = []BatchJob{{Name: tt.bjName, Schedule: "0 * * * *"}}
+			errList := ac.validateSpec()
+			if (len(errList) > 0) != tt.wantErr {
+				t.Errorf("errors = %v, wantErr %v", errList, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefaultActionBy(t *testing.T) {
+	defer func(user string) { operatorUser = user }(operatorUser)
+	operatorUser = getOperatorUser("app-operator-system", "app-operator-controller-manager")
+
+	newAppConfig := func(action, user string) *AppConfig {
+		ac := &AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+		if action != "" {
+			AddAnnotation(ac, ActionAnnotation, action)
+		}
+		if user != "" {
+			AddAnnotation(ac, ActionByAnnotation, user)
+		}
+		return ac
+	}
+	tests := []struct {
+		name     string
+		user     string
+		old      *AppConfig
+		new      *AppConfig
+		wantUser string
+	}{
+		{name: "create with forged action-by", user: "alice", new: newAppConfig(string(PromoteAction), "mallory"), wantUser: "alice"},
+		{name: "new action", user: "alice", old: newAppConfig("", ""), new: newAppConfig(string(AbortAction), ""), wantUser: "alice"},
+		{name: "forge pending action", user: "mallory", old: newAppConfig(string(PromoteAction), "alice"), new: newAppConfig(string(PromoteAction), "mallory"), wantUser: "alice"},
+		{name: "action-by without action", user: "mallory", old: newAppConfig("", ""), new: newAppConfig("", "alice")},
+		{name: "operator api", user: operatorUser, old: newAppConfig("", ""), new: newAppConfig(string(PromoteAction), "alice"), wantUser: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				UserInfo:  authenticationv1.UserInfo{Username: tt.user},
+			}}
+			if tt.old != nil {
+				raw, err := json.Marshal(tt.old)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Operation = admissionv1.Update
+				req.OldObject = runtime.RawExtension{Raw: raw}
+			}
+			ctx := admission.NewContextWithRequest(context.Background(), req)
+			if err := (&appConfigDefaulter{}).Default(ctx, tt.new); err != nil {
+				t.Fatal(err)
+			}
+			if user := GetAnnotation(tt.new, ActionByAnnotation); user != tt.wantUser {
+				t.Errorf("action-by = %q, want %q", user, tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImagePolicy 镜像约束
+type ImagePolicy struct {
+	// AllowedRegistries 允许使用的镜像仓库，例如 registry.example.com，为空时不限制
+	// +optional
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+	// RequireDigest 镜像必须带 digest，和 RequireSemverTag 同时开启时满足其一即可
+	// +optional
+	RequireDigest bool `json:"requireDigest,omitempty"`
+	// RequireSemverTag 镜像 tag 必须是语义化版本，例如 v1.2.3
+	// +optional
+	RequireSemverTag bool `json:"requireSemverTag,omitempty"`
+	// DeniedTags 禁止使用的 tag，例如 latest
+	// +optional
+	DeniedTags []string `json:"deniedTags,omitempty"`
+}
+
+// AppPolicySpec defines the desired state of AppPolicy
+type AppPolicySpec struct {
+	// DefaultAnnotations AppConfig 没有设置时使用的注解，key 不带 app.sanmuyan.com/ 前缀，例如 strict-release
+	// +optional
+	DefaultAnnotations map[string]string `json:"defaultAnnotations,omitempty"`
+	// ForcedAnnotations 强制覆盖 AppConfig 的注解，key 不带 app.sanmuyan.com/ 前缀
+	// +optional
+	ForcedAnnotations map[string]string `json:"forcedAnnotations,omitempty"`
+	// AllowedIngressHosts 允许使用的 ingress host，支持 *.example.com 形式的通配，为空时不限制
+	// +optional
+	AllowedIngressHosts []string `json:"allowedIngressHosts,omitempty"`
+	// MaxReplicas 每个 deployConfig 允许的最大副本数
+	// +optional
+	MaxReplicas *int32 `json:"maxReplicas,omitempty"`
+	// ImagePolicy deployConfig 镜像约束
+	// +optional
+	ImagePolicy *ImagePolicy `json:"imagePolicy,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AppPolicy is the Schema for the apppolicies API
+// 为命名空间下所有的 AppConfig 提供默认值和强制约束
+type AppPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec AppPolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AppPolicyList contains a list of AppPolicy
+type AppPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AppPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AppPolicy{}, &AppPolicyList{})
+}
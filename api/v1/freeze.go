@@ -0,0 +1,115 @@
+package v1
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"time"
+)
+
+// maxFreezeFires 计算冻结窗口结束时间时合并的最大触发次数，避免窗口始终重叠时无限循环
+const maxFreezeFires = 1000
+
+// FrozenIndefinitely 窗口连续重叠超过 maxFreezeFires 次、无法计算结束时间时返回的结束时间
+var FrozenIndefinitely = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+// IsFrozenIndefinitely 判断冻结窗口的结束时间是否无法计算
+func IsFrozenIndefinitely(t time.Time) bool {
+	return !t.Before(FrozenIndefinitely)
+}
+
+// ActiveUntil 返回 t 时刻冻结窗口的结束时间，不在窗口内时返回 false
+func (w *FreezeWindow) ActiveUntil(t time.Time) (time.Time, bool, error) {
+	if w.Schedule != NilValue {
+		if w.Duration == nil || w.Duration.Duration <= 0 {
+			return time.Time{}, false, fmt.Errorf("duration is required with schedule")
+		}
+		sched, err := cron.ParseStandard(w.Schedule)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		// 在 [t-duration, t] 之间触发过则处于窗口内，窗口重叠时以最晚的触发时间计算结束时间
+		fire := sched.Next(t.Add(-w.Duration.Duration))
+		if fire.After(t) {
+			return time.Time{}, false, nil
+		}
+		end := fire.Add(w.Duration.Duration)
+		// 结束前再次触发时窗口连续，最多向后合并 maxFreezeFires 次，超过时无法计算结束时间
+		for i := 0; ; i++ {
+			if i == maxFreezeFires {
+				return FrozenIndefinitely, true, nil
+			}
+			fire = sched.Next(fire)
+			if fire.IsZero() || !fire.Before(end) {
+				break
+			}
+			end = fire.Add(w.Duration.Duration)
+		}
+		return end, true, nil
+	}
+	if w.Start == nil || w.End == nil {
+		return time.Time{}, false, fmt.Errorf("schedule or start and end is required")
+	}
+	if !w.End.After(w.Start.Time) {
+		return time.Time{}, false, fmt.Errorf("end must be after start")
+	}
+	if t.Before(w.Start.Time) || !t.Before(w.End.Time) {
+		return time.Time{}, false, nil
+	}
+	return w.End.Time, true, nil
+}
+
+// FormatFrozenUntil 返回冻结窗口结束时间的描述
+func FormatFrozenUntil(t time.Time) string {
+	if IsFrozenIndefinitely(t) {
+		return "indefinitely"
+	}
+	return "until " + t.Format(time.RFC3339)
+}
+
+// Validate 检查冻结窗口的配置，持续时间不短于 cron 触发间隔时窗口始终重叠，永远不会结束
+func (w *FreezeWindow) Validate(t time.Time) error {
+	if _, _, err := w.ActiveUntil(t); err != nil {
+		return err
+	}
+	if w.Schedule == NilValue {
+		return nil
+	}
+	sched, err := cron.ParseStandard(w.Schedule)
+	if err != nil {
+		return err
+	}
+	// 按最长的触发间隔计算，只要有一个间隔大于持续时间窗口就会结束
+	var period time.Duration
+	fire := sched.Next(t)
+	for i := 0; i < maxFreezeFires && !fire.IsZero(); i++ {
+		next := sched.Next(fire)
+		if next.IsZero() {
+			break
+		}
+		if gap := next.Sub(fire); gap > period {
+			period = gap
+		}
+		fire = next
+	}
+	if period > 0 && w.Duration.Duration >= period {
+		return fmt.Errorf("duration %s must be shorter than the schedule period %s", w.Duration.Duration, period)
+	}
+	return nil
+}
+
+// FrozenUntil 返回 t 时刻所有生效冻结窗口中最晚的结束时间
+func FrozenUntil(windows []FreezeWindow, t time.Time) (time.Time, bool) {
+	var until time.Time
+	frozen := false
+	for i := range windows {
+		end, ok, err := windows[i].ActiveUntil(t)
+		if err != nil || !ok {
+			continue
+		}
+		frozen = true
+		if end.After(until) {
+			until = end
+		}
+	}
+	return until, frozen
+}
@@ -0,0 +1,139 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestFreezeWindowActiveUntil(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	duration := func(d time.Duration) *metav1.Duration {
+		return &metav1.Duration{Duration: d}
+	}
+	metaTime := func(s string) *metav1.Time {
+		tm := metav1.NewTime(at(s))
+		return &tm
+	}
+
+	tests := []struct {
+		name       string
+		window     FreezeWindow
+		t          string
+		wantActive bool
+		wantUntil  string
+		wantErr    bool
+	}{
+		{
+			name:       "inside single window",
+			window:     FreezeWindow{Schedule: "0 10 * * *", Duration: duration(2 * time.Hour)},
+			t:          "2024-01-01T11:00:00Z",
+			wantActive: true,
+			wantUntil:  "2024-01-01T12:00:00Z",
+		},
+		{
+			name:   "outside window",
+			window: FreezeWindow{Schedule: "0 10 * * *", Duration: duration(2 * time.Hour)},
+			t:      "2024-01-01T12:00:00Z",
+		},
+		{
+			name:       "overlapping fires use the latest fire",
+			window:     FreezeWindow{Schedule: "0 9,10 * * *", Duration: duration(90 * time.Minute)},
+			t:          "2024-01-01T10:15:00Z",
+			wantActive: true,
+			// 09:00 和 10:00 的窗口都覆盖 10:15，结束时间以 10:00 计算
+			wantUntil: "2024-01-01T11:30:00Z",
+		},
+		{
+			name:       "overlapping fires chain until a gap",
+			window:     FreezeWindow{Schedule: "0,30 10 * * *", Duration: duration(45 * time.Minute)},
+			t:          "2024-01-01T10:20:00Z",
+			wantActive: true,
+			wantUntil:  "2024-01-01T11:15:00Z",
+		},
+		{
+			name:       "latest fire in range",
+			window:     FreezeWindow{Schedule: "0,30 10 * * *", Duration: duration(45 * time.Minute)},
+			t:          "2024-01-01T10:40:00Z",
+			wantActive: true,
+			wantUntil:  "2024-01-01T11:15:00Z",
+		},
+		{
+			name:       "always overlapping",
+			window:     FreezeWindow{Schedule: "* * * * *", Duration: duration(2 * time.Minute)},
+			t:          "2024-01-01T10:00:30Z",
+			wantActive: true,
+			wantUntil:  "9999-12-31T23:59:59Z",
+		},
+		{
+			name:    "schedule without duration",
+			window:  FreezeWindow{Schedule: "0 10 * * *"},
+			t:       "2024-01-01T10:00:00Z",
+			wantErr: true,
+		},
+		{
+			name:       "start and end",
+			window:     FreezeWindow{Start: metaTime("2024-01-01T00:00:00Z"), End: metaTime("2024-01-02T00:00:00Z")},
+			t:          "2024-01-01T12:00:00Z",
+			wantActive: true,
+			wantUntil:  "2024-01-02T00:00:00Z",
+		},
+		{
+			name:   "after end",
+			window: FreezeWindow{Start: metaTime("2024-01-01T00:00:00Z"), End: metaTime("2024-01-02T00:00:00Z")},
+			t:      "2024-01-02T00:00:00Z",
+		},
+		{
+			name:    "end before start",
+			window:  FreezeWindow{Start: metaTime("2024-01-02T00:00:00Z"), End: metaTime("2024-01-01T00:00:00Z")},
+			t:       "2024-01-01T12:00:00Z",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until, active, err := tt.window.ActiveUntil(at(tt.t))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if active != tt.wantActive {
+				t.Fatalf("active = %v, want %v", active, tt.wantActive)
+			}
+			if tt.wantActive && !until.Equal(at(tt.wantUntil)) {
+				t.Errorf("until = %s, want %s", until.Format(time.RFC3339), tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestFreezeWindowValidate(t *testing.T) {
+	duration := func(d time.Duration) *metav1.Duration {
+		return &metav1.Duration{Duration: d}
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		window  FreezeWindow
+		wantErr bool
+	}{
+		{name: "shorter than period", window: FreezeWindow{Schedule: "0 10 * * *", Duration: duration(2 * time.Hour)}},
+		{name: "overlapping fires with a gap", window: FreezeWindow{Schedule: "0 9,10 * * *", Duration: duration(90 * time.Minute)}},
+		{name: "longer than period", window: FreezeWindow{Schedule: "0 10 * * *", Duration: duration(48 * time.Hour)}, wantErr: true},
+		{name: "equal to period", window: FreezeWindow{Schedule: "* * * * *", Duration: duration(time.Minute)}, wantErr: true},
+		{name: "invalid schedule", window: FreezeWindow{Schedule: "invalid", Duration: duration(time.Hour)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.window.Validate(now); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
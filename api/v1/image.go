@@ -0,0 +1,175 @@
+package v1
+
+import (
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRegistry 没有指定仓库地址时使用的默认仓库
+	DefaultRegistry = "docker.io"
+	// DefaultTag 没有指定 tag 和 digest 时使用的默认 tag
+	DefaultTag = "latest"
+	// DefaultImageWatchInterval 镜像自动更新默认的拉取间隔
+	DefaultImageWatchInterval = 5 * time.Minute
+	// MinImageWatchInterval 镜像自动更新最小的拉取间隔
+	MinImageWatchInterval = time.Minute
+)
+
+var semverTagRegexp = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// ImageRef 解析后的镜像地址
+type ImageRef struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseImage 解析镜像地址，格式为 [registry/]repository[:tag][@digest]
+func ParseImage(image string) ImageRef {
+	ref := ImageRef{}
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i+1:], "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			ref.Registry = first
+			name = name[i+1:]
+		}
+	}
+	if ref.Registry == NilValue {
+		ref.Registry = DefaultRegistry
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+	ref.Repository = name
+	if ref.Tag == NilValue && ref.Digest == NilValue {
+		ref.Tag = DefaultTag
+	}
+	return ref
+}
+
+// String 返回完整的镜像地址
+func (r ImageRef) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != NilValue {
+		s += ":" + r.Tag
+	}
+	if r.Digest != NilValue {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// IsSemverTag 判断 tag 是否是语义化版本
+func IsSemverTag(tag string) bool {
+	return semverTagRegexp.MatchString(tag)
+}
+
+// ReplaceTag 替换镜像地址中的 tag，并去掉 digest
+func ReplaceTag(image, tag string) string {
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i+1:], "/") {
+		name = name[:i]
+	}
+	return name + ":" + tag
+}
+
+// GetInterval 返回拉取间隔
+func (w *ImageWatch) GetInterval() time.Duration {
+	if w.Interval == nil || w.Interval.Duration <= 0 {
+		return DefaultImageWatchInterval
+	}
+	return w.Interval.Duration
+}
+
+// Validate 检查配置是否合法
+func (w *ImageWatch) Validate() error {
+	if w.SemverRange == NilValue && w.TagPattern == NilValue {
+		return fmt.Errorf("semverRange or tagPattern is required")
+	}
+	if w.SemverRange != NilValue {
+		if _, err := semver.NewConstraint(w.SemverRange); err != nil {
+			return err
+		}
+	}
+	if w.TagPattern != NilValue {
+		if _, err := regexp.Compile(w.TagPattern); err != nil {
+			return err
+		}
+	}
+	if w.GetInterval() < MinImageWatchInterval {
+		return fmt.Errorf("interval must be at least %s", MinImageWatchInterval)
+	}
+	return nil
+}
+
+// LatestTag 从 tag 列表中选择满足条件的最新 tag
+func (w *ImageWatch) LatestTag(tags []string) (string, error) {
+	var pattern *regexp.Regexp
+	if w.TagPattern != NilValue {
+		var err error
+		if pattern, err = regexp.Compile(w.TagPattern); err != nil {
+			return "", err
+		}
+	}
+	var constraint *semver.Constraints
+	if w.SemverRange != NilValue {
+		var err error
+		if constraint, err = semver.NewConstraint(w.SemverRange); err != nil {
+			return "", err
+		}
+	}
+
+	var candidates []string
+	for _, tag := range tags {
+		if pattern != nil && !pattern.MatchString(tag) {
+			continue
+		}
+		if constraint != nil {
+			v, err := semver.NewVersion(tag)
+			if err != nil || !constraint.Check(v) {
+				continue
+			}
+		}
+		candidates = append(candidates, tag)
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return lessTag(candidates[i], candidates[j])
+	})
+	return candidates[len(candidates)-1], nil
+}
+
+// ShouldUpdate 判断是否需要从当前 tag 更新到 latest，不会降级
+func (w *ImageWatch) ShouldUpdate(current, latest string) bool {
+	return latest != NilValue && latest != current && !lessTag(latest, current)
+}
+
+// lessTag 都是语义化版本时按版本比较，否则按字母顺序比较
+func lessTag(a, b string) bool {
+	va, errA := semver.NewVersion(a)
+	vb, errB := semver.NewVersion(b)
+	if errA == nil && errB == nil {
+		return va.LessThan(vb)
+	}
+	return a < b
+}
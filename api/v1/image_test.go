@@ -0,0 +1,61 @@
+package v1
+
+import "testing"
+
+func TestImageWatchLatestTag(t *testing.T) {
+	tags := []string{"latest", "v1.0.0", "v1.2.0", "v1.10.0", "v2.0.0-rc.1", "v2.0.0", "main-20240101", "main-20240301", "main-20240201"}
+	tests := []struct {
+		name    string
+		watch   ImageWatch
+		tags    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "semver range", watch: ImageWatch{SemverRange: ">=1.0.0 <2.0.0"}, tags: tags, want: "v1.10.0"},
+		{name: "semver without prerelease", watch: ImageWatch{SemverRange: ">=1.0.0"}, tags: tags, want: "v2.0.0"},
+		{name: "semver prerelease", watch: ImageWatch{SemverRange: ">=2.0.0-0"}, tags: []string{"v1.0.0", "v2.0.0-rc.1"}, want: "v2.0.0-rc.1"},
+		{name: "tag pattern semver order", watch: ImageWatch{TagPattern: `^v1\.`}, tags: tags, want: "v1.10.0"},
+		{name: "tag pattern alphabetical order", watch: ImageWatch{TagPattern: `^main-`}, tags: tags, want: "main-20240301"},
+		{name: "pattern and range", watch: ImageWatch{SemverRange: "<2.0.0", TagPattern: `^v1\.[0-2]\.`}, tags: tags, want: "v1.2.0"},
+		{name: "no match", watch: ImageWatch{SemverRange: ">=3.0.0"}, tags: tags, want: ""},
+		{name: "no tags", watch: ImageWatch{SemverRange: ">=1.0.0"}, want: ""},
+		{name: "invalid range", watch: ImageWatch{SemverRange: "not a range"}, tags: tags, wantErr: true},
+		{name: "invalid pattern", watch: ImageWatch{TagPattern: "("}, tags: tags, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.watch.LatestTag(tt.tags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LatestTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("LatestTag() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageWatchShouldUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		latest  string
+		want    bool
+	}{
+		{name: "newer semver", current: "v1.2.0", latest: "v1.10.0", want: true},
+		{name: "same tag", current: "v1.2.0", latest: "v1.2.0", want: false},
+		{name: "no downgrade", current: "v1.10.0", latest: "v1.2.0", want: false},
+		{name: "release after prerelease", current: "v2.0.0-rc.1", latest: "v2.0.0", want: true},
+		{name: "newer alphabetical", current: "main-20240101", latest: "main-20240301", want: true},
+		{name: "older alphabetical", current: "main-20240301", latest: "main-20240101", want: false},
+		{name: "no latest", current: "v1.2.0", latest: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &ImageWatch{}
+			if got := w.ShouldUpdate(tt.current, tt.latest); got != tt.want {
+				t.Errorf("ShouldUpdate(%q, %q) = %v, want %v", tt.current, tt.latest, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,43 +2,242 @@ package v1
 
 import (
 	"context"
+	"fmt"
+	"gomodules.xyz/jsonpatch/v2"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/util/json"
 	"net/http"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // Kubebuilder 不支持核心类型的 webhook 所以需要自定义处理
 
 // +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=fail,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=mpod.kb.io,admissionReviewVersions=v1
 
+//+kubebuilder:rbac:groups=app.sanmuyan.com,resources=sidecarprofiles,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// +kubebuilder:object:generate=false
+
 type PodAnnotator struct {
 	Client  client.Client
 	Decoder *admission.Decoder
+	// FailOpen 处理失败时放行 Pod 而不是拒绝
+	FailOpen bool
 }
 
 var _ admission.Handler = &PodAnnotator{}
 
+// Injection 注入到 Pod 的内容，已存在的同名容器、卷和环境变量不会重复注入
+type Injection struct {
+	// Containers 追加的容器
+	// +optional
+	Containers []corev1.Container `json:"containers,omitempty"`
+	// InitContainers 追加的 init 容器
+	// +optional
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+	// Volumes 追加的卷
+	// +optional
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+	// Env 追加到 app 容器的环境变量
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+}
+
 func (a *PodAnnotator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	ns, err := a.getNamespace(ctx, req.Namespace)
+	if err != nil {
+		return a.errored(http.StatusInternalServerError, err)
+	}
+	// 和 webhook 配置的 namespaceSelector 相同，打了 injection=disabled 标签的命名空间不处理
+	if GetLabel(ns, InjectionLabel) == DisabledValue {
+		return admission.Allowed("namespace is excluded")
+	}
 	pod := &corev1.Pod{}
-	err := a.Decoder.Decode(req, pod)
+	err = a.Decoder.Decode(req, pod)
 	if err != nil {
-		return admission.Errored(http.StatusBadRequest, err)
+		return a.errored(http.StatusBadRequest, err)
+	}
+	// 只处理 operator 管理的 Pod
+	if GetLabel(pod, InjectionLabel) != TureValue {
+		return admission.Allowed("pod is not managed by " + OperatorName)
 	}
 
+	injection := &Injection{}
 	if v := GetAnnotation(pod, ContainersInjectionAnnotation); v != NilValue {
-		var containers []corev1.Container
-		err := json.Unmarshal([]byte(v), &containers)
+		injection, err = ParseInjection(v)
 		if err != nil {
-			return admission.Errored(http.StatusBadRequest, err)
+			return a.errored(http.StatusBadRequest, err)
 		}
-		pod.Spec.Containers = append(pod.Spec.Containers, containers...)
 	}
-
-	marshaledPod, err := json.Marshal(pod)
+	profile, err := a.getSidecarProfile(ctx, pod, ns)
+	if apierrors.IsNotFound(err) {
+		return a.errored(http.StatusForbidden, err)
+	}
 	if err != nil {
-		return admission.Errored(http.StatusInternalServerError, err)
+		return a.errored(http.StatusInternalServerError, err)
+	}
+	if profile != nil {
+		injection.Merge(&profile.Spec.Injection)
+	}
+	patches := InjectionPatch(pod, injection)
+	if profile != nil {
+		// 记录注入来源，方便排查 sidecar 的版本
+		patches = append(patches, annotationPatch(pod, map[string]string{
+			InjectedProfileAnnotation:        profile.Name,
+			InjectedProfileVersionAnnotation: strconv.FormatInt(profile.Generation, 10),
+		})...)
+	}
+	if len(patches) == 0 {
+		return admission.Allowed("")
+	}
+	// dry-run 请求返回同样的 patch，但不产生日志等副作用
+	if req.DryRun == nil || !*req.DryRun {
+		log := logf.FromContext(ctx)
+		if profile != nil {
+			log.Info("pod injected", "namespace", req.Namespace, "name", pod.GenerateName+pod.Name, "profile", profile.Name, "version", profile.Generation)
+		} else {
+			log.V(1).Info("pod injected", "namespace", req.Namespace, "name", pod.GenerateName+pod.Name)
+		}
 	}
-	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+	return admission.Patched("", patches...)
+}
+
+// errored 开启 FailOpen 时放行 Pod 并返回警告
+func (a *PodAnnotator) errored(code int32, err error) admission.Response {
+	if a.FailOpen {
+		return admission.Allowed("").WithWarnings(fmt.Sprintf("%s skipped injection: %v", OperatorName, err))
+	}
+	return admission.Errored(code, err)
+}
+
+// getNamespace 获取 Pod 所在的命名空间，不存在时返回空的命名空间
+func (a *PodAnnotator) getNamespace(ctx context.Context, namespace string) (*corev1.Namespace, error) {
+	ns := &corev1.Namespace{}
+	ns.Name = namespace
+	if a.Client == nil {
+		return ns, nil
+	}
+	if err := a.Client.Get(ctx, client.ObjectKey{Name: namespace}, ns); client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// getSidecarProfile 获取 Pod 引用的 SidecarProfile，Pod 没有引用时使用命名空间的默认值
+func (a *PodAnnotator) getSidecarProfile(ctx context.Context, pod *corev1.Pod, ns *corev1.Namespace) (*SidecarProfile, error) {
+	if a.Client == nil {
+		return nil, nil
+	}
+	name := GetAnnotation(pod, SidecarProfileAnnotation)
+	if name == NilValue {
+		name = GetAnnotation(ns, SidecarProfileAnnotation)
+	}
+	if name == NilValue {
+		return nil, nil
+	}
+	profile := &SidecarProfile{}
+	if err := a.Client.Get(ctx, client.ObjectKey{Namespace: ns.Name, Name: name}, profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// ParseInjection 解析注入注解，兼容只有容器数组的旧格式
+func ParseInjection(v string) (*Injection, error) {
+	injection := &Injection{}
+	if strings.HasPrefix(strings.TrimSpace(v), "[") {
+		return injection, json.Unmarshal([]byte(v), &injection.Containers)
+	}
+	return injection, json.Unmarshal([]byte(v), injection)
+}
+
+// Merge 追加其它注入内容，同名时保留已有的
+func (in *Injection) Merge(other *Injection) {
+	in.Containers = append(in.Containers, other.Containers...)
+	in.InitContainers = append(in.InitContainers, other.InitContainers...)
+	in.Volumes = append(in.Volumes, other.Volumes...)
+	in.Env = append(in.Env, other.Env...)
+}
+
+// InjectionPatch 生成最小的 RFC 6902 patch，按名称跳过 Pod 中已存在的容器、卷和环境变量
+func InjectionPatch(pod *corev1.Pod, injection *Injection) []jsonpatch.JsonPatchOperation {
+	var patches []jsonpatch.JsonPatchOperation
+	patches = append(patches, addPatch("/spec/initContainers", pod.Spec.InitContainers, injection.InitContainers, containerName)...)
+	patches = append(patches, addPatch("/spec/containers", pod.Spec.Containers, injection.Containers, containerName)...)
+	patches = append(patches, addPatch("/spec/volumes", pod.Spec.Volumes, injection.Volumes, volumeName)...)
+	for i, c := range pod.Spec.Containers {
+		if c.Name == AppName {
+			patches = append(patches, addPatch(fmt.Sprintf("/spec/containers/%d/env", i), c.Env, injection.Env, envName)...)
+		}
+	}
+	return patches
+}
+
+// annotationPatch 添加或覆盖 Pod 的注解
+func annotationPatch(pod *corev1.Pod, annotations map[string]string) []jsonpatch.JsonPatchOperation {
+	if len(pod.Annotations) == 0 {
+		values := make(map[string]string)
+		for k, v := range annotations {
+			values[LabelPrefix+"/"+k] = v
+		}
+		return []jsonpatch.JsonPatchOperation{jsonpatch.NewOperation("add", "/metadata/annotations", values)}
+	}
+	keys := make([]string, 0, len(annotations))
+	for k := range annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var patches []jsonpatch.JsonPatchOperation
+	for _, k := range keys {
+		// JSON Pointer 中的 / 需要转义为 ~1
+		path := "/metadata/annotations/" + strings.ReplaceAll(LabelPrefix+"/"+k, "/", "~1")
+		patches = append(patches, jsonpatch.NewOperation("add", path, annotations[k]))
+	}
+	return patches
+}
+
+func addPatch[T any](path string, existing, added []T, name func(T) string) []jsonpatch.JsonPatchOperation {
+	names := make(map[string]bool)
+	for _, e := range existing {
+		names[name(e)] = true
+	}
+	var items []T
+	for _, a := range added {
+		if names[name(a)] {
+			continue
+		}
+		names[name(a)] = true
+		items = append(items, a)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	// 数组不存在时需要整体添加
+	if len(existing) == 0 {
+		return []jsonpatch.JsonPatchOperation{jsonpatch.NewOperation("add", path, items)}
+	}
+	var patches []jsonpatch.JsonPatchOperation
+	for _, item := range items {
+		patches = append(patches, jsonpatch.NewOperation("add", path+"/-", item))
+	}
+	return patches
+}
+
+func containerName(c corev1.Container) string {
+	return c.Name
+}
+
+func volumeName(v corev1.Volume) string {
+	return v.Name
+}
+
+func envName(e corev1.EnvVar) string {
+	return e.Name
 }
@@ -0,0 +1,290 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	jsonpatchv5 "github.com/evanphx/json-patch/v5"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"net/http"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"testing"
+)
+
+func newInjectionPod(annotation string, containers, initContainers []string, volumes []string) *corev1.Pod {
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+	}
+	AddLabel(pod, InjectionLabel, TureValue)
+	if annotation != "" {
+		AddAnnotation(pod, ContainersInjectionAnnotation, annotation)
+	}
+	for _, name := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name, Image: name})
+	}
+	for _, name := range initContainers {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Name: name, Image: name})
+	}
+	for _, name := range volumes {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: name})
+	}
+	return pod
+}
+
+func podNames(pod *corev1.Pod) (containers, initContainers, volumes []string) {
+	for _, c := range pod.Spec.Containers {
+		containers = append(containers, c.Name)
+	}
+	for _, c := range pod.Spec.InitContainers {
+		initContainers = append(initContainers, c.Name)
+	}
+	for _, v := range pod.Spec.Volumes {
+		volumes = append(volumes, v.Name)
+	}
+	return
+}
+
+func getTestContainer(name string, containers []corev1.Container) (corev1.Container, bool) {
+	for _, c := range containers {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return corev1.Container{}, false
+}
+
+func TestPodAnnotatorHandle(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	decoder := admission.NewDecoder(scheme)
+
+	profile := &SidecarProfile{
+		ObjectMeta: metav1.ObjectMeta{Name: "mesh", Namespace: "default"},
+		Spec: SidecarProfileSpec{Injection: Injection{
+			Containers:     []corev1.Container{{Name: "mesh-proxy", Image: "mesh-proxy"}},
+			InitContainers: []corev1.Container{{Name: "mesh-init", Image: "mesh-init"}},
+			Env:            []corev1.EnvVar{{Name: "MESH", Value: "true"}},
+		}},
+	}
+	meshNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	AddAnnotation(meshNamespace, SidecarProfileAnnotation, "mesh")
+	disabledNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "operator"}}
+	AddLabel(disabledNamespace, InjectionLabel, DisabledValue)
+	profilePod := newInjectionPod(`[{"name":"proxy","image":"proxy"}]`, []string{AppName}, nil, nil)
+	AddAnnotation(profilePod, SidecarProfileAnnotation, "mesh")
+	missingProfilePod := newInjectionPod("", []string{AppName}, nil, nil)
+	AddAnnotation(missingProfilePod, SidecarProfileAnnotation, "missing")
+
+	tests := []struct {
+		name               string
+		pod                *corev1.Pod
+		namespace          string
+		objects            []client.Object
+		failOpen           bool
+		dryRun             bool
+		wantAllowed        bool
+		wantCode           int32
+		wantPatches        int
+		wantContainers     []string
+		wantInitContainers []string
+		wantVolumes        []string
+		wantEnv            []string
+		wantProfile        string
+	}{
+		{
+			name:           "no annotation",
+			pod:            newInjectionPod("", []string{"app"}, nil, nil),
+			wantAllowed:    true,
+			wantContainers: []string{"app"},
+		},
+		{
+			name:           "pod without injection label",
+			pod:            &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app"}}}},
+			wantAllowed:    true,
+			wantContainers: []string{"app"},
+		},
+		{
+			name:           "excluded namespace",
+			pod:            newInjectionPod(`[{"name":"proxy","image":"proxy"}]`, []string{"app"}, nil, nil),
+			namespace:      "operator",
+			objects:        []client.Object{disabledNamespace},
+			wantAllowed:    true,
+			wantContainers: []string{"app"},
+		},
+		{
+			name:           "legacy container array",
+			pod:            newInjectionPod(`[{"name":"proxy","image":"proxy"}]`, []string{"app"}, nil, nil),
+			wantAllowed:    true,
+			wantPatches:    1,
+			wantContainers: []string{"app", "proxy"},
+		},
+		{
+			name:           "sidecar already present",
+			pod:            newInjectionPod(`[{"name":"proxy","image":"proxy"}]`, []string{"app", "proxy"}, nil, nil),
+			wantAllowed:    true,
+			wantContainers: []string{"app", "proxy"},
+		},
+		{
+			name:           "duplicate names in annotation",
+			pod:            newInjectionPod(`[{"name":"proxy","image":"proxy"},{"name":"proxy","image":"proxy:v2"}]`, []string{"app"}, nil, nil),
+			wantAllowed:    true,
+			wantPatches:    1,
+			wantContainers: []string{"app", "proxy"},
+		},
+		{
+			name: "merge init containers and volumes",
+			pod: newInjectionPod(`{"containers":[{"name":"proxy","image":"proxy"}],"initContainers":[{"name":"init","image":"init"}],"volumes":[{"name":"certs"},{"name":"data"}]}`,
+				[]string{"app"}, nil, []string{"data"}),
+			wantAllowed:        true,
+			wantPatches:        3,
+			wantContainers:     []string{"app", "proxy"},
+			wantInitContainers: []string{"init"},
+			wantVolumes:        []string{"data", "certs"},
+		},
+		{
+			name:               "profile from pod annotation",
+			pod:                profilePod,
+			objects:            []client.Object{profile},
+			wantAllowed:        true,
+			wantPatches:        6,
+			wantProfile:        "mesh",
+			wantContainers:     []string{AppName, "proxy", "mesh-proxy"},
+			wantInitContainers: []string{"mesh-init"},
+			wantEnv:            []string{"MESH"},
+		},
+		{
+			name:               "profile from namespace annotation",
+			pod:                newInjectionPod("", []string{AppName}, nil, nil),
+			objects:            []client.Object{profile, meshNamespace},
+			wantAllowed:        true,
+			wantPatches:        4,
+			wantProfile:        "mesh",
+			wantContainers:     []string{AppName, "mesh-proxy"},
+			wantInitContainers: []string{"mesh-init"},
+			wantEnv:            []string{"MESH"},
+		},
+		{
+			name:               "profile with dry run",
+			pod:                newInjectionPod("", []string{AppName}, nil, nil),
+			objects:            []client.Object{profile, meshNamespace},
+			dryRun:             true,
+			wantAllowed:        true,
+			wantPatches:        4,
+			wantProfile:        "mesh",
+			wantContainers:     []string{AppName, "mesh-proxy"},
+			wantInitContainers: []string{"mesh-init"},
+			wantEnv:            []string{"MESH"},
+		},
+		{
+			name:        "missing profile",
+			pod:         missingProfilePod,
+			wantAllowed: false,
+			wantCode:    http.StatusForbidden,
+		},
+		{
+			name:        "invalid annotation",
+			pod:         newInjectionPod(`[{"name":`, []string{"app"}, nil, nil),
+			wantAllowed: false,
+			wantCode:    http.StatusBadRequest,
+		},
+		{
+			name:           "invalid annotation with fail open",
+			pod:            newInjectionPod(`[{"name":`, []string{"app"}, nil, nil),
+			failOpen:       true,
+			wantAllowed:    true,
+			wantContainers: []string{"app"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal(tt.pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			namespace := tt.namespace
+			if namespace == "" {
+				namespace = "default"
+			}
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Namespace: namespace,
+				DryRun:    &tt.dryRun,
+				Object:    runtime.RawExtension{Raw: raw},
+			}}
+			a := &PodAnnotator{
+				Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(tt.objects...).Build(),
+				Decoder:  decoder,
+				FailOpen: tt.failOpen,
+			}
+			resp := a.Handle(context.Background(), req)
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Allowed = %v, want %v (%v)", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+			if !tt.wantAllowed {
+				if resp.Result.Code != tt.wantCode {
+					t.Errorf("Code = %d, want %d", resp.Result.Code, tt.wantCode)
+				}
+				return
+			}
+			if len(resp.Patches) != tt.wantPatches {
+				t.Fatalf("got %d patches, want %d: %v", len(resp.Patches), tt.wantPatches, resp.Patches)
+			}
+
+			patched := raw
+			if len(resp.Patches) > 0 {
+				ops, err := json.Marshal(resp.Patches)
+				if err != nil {
+					t.Fatal(err)
+				}
+				patch, err := jsonpatchv5.DecodePatch(ops)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if patched, err = patch.Apply(raw); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pod := &corev1.Pod{}
+			if err := json.Unmarshal(patched, pod); err != nil {
+				t.Fatal(err)
+			}
+			containers, initContainers, volumes := podNames(pod)
+			if !reflect.DeepEqual(containers, tt.wantContainers) {
+				t.Errorf("containers = %v, want %v", containers, tt.wantContainers)
+			}
+			if !reflect.DeepEqual(initContainers, tt.wantInitContainers) {
+				t.Errorf("initContainers = %v, want %v", initContainers, tt.wantInitContainers)
+			}
+			if !reflect.DeepEqual(volumes, tt.wantVolumes) {
+				t.Errorf("volumes = %v, want %v", volumes, tt.wantVolumes)
+			}
+			var env []string
+			if c, ok := getTestContainer(AppName, pod.Spec.Containers); ok {
+				for _, e := range c.Env {
+					env = append(env, e.Name)
+				}
+			}
+			if !reflect.DeepEqual(env, tt.wantEnv) {
+				t.Errorf("env = %v, want %v", env, tt.wantEnv)
+			}
+			if profile := GetAnnotation(pod, InjectedProfileAnnotation); profile != tt.wantProfile {
+				t.Errorf("injected profile = %q, want %q", profile, tt.wantProfile)
+			}
+			if tt.wantProfile != "" && GetAnnotation(pod, InjectedProfileVersionAnnotation) == "" {
+				t.Errorf("injected profile version is empty")
+			}
+		})
+	}
+}
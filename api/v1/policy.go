@@ -0,0 +1,134 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+)
+
+// ListAppPolicies 获取命名空间下的所有 AppPolicy，按名称排序
+func ListAppPolicies(ctx context.Context, c client.Reader, namespace string) ([]AppPolicy, error) {
+	policyList := &AppPolicyList{}
+	if err := c.List(ctx, policyList, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	sort.Slice(policyList.Items, func(i, j int) bool {
+		return policyList.Items[i].Name < policyList.Items[j].Name
+	})
+	return policyList.Items, nil
+}
+
+// ApplyAppPolicies 按顺序把策略的默认注解和强制注解写入 AppConfig
+func ApplyAppPolicies(ac *AppConfig, policies []AppPolicy) {
+	for _, p := range policies {
+		for k, v := range p.Spec.DefaultAnnotations {
+			if GetAnnotation(ac, k) == NilValue {
+				AddAnnotation(ac, k, v)
+			}
+		}
+	}
+	for _, p := range policies {
+		for k, v := range p.Spec.ForcedAnnotations {
+			AddAnnotation(ac, k, v)
+		}
+	}
+}
+
+// ValidateAppPolicies 检查 AppConfig 是否满足所有策略的约束
+func ValidateAppPolicies(ac *AppConfig, policies []AppPolicy) field.ErrorList {
+	var errList field.ErrorList
+	for _, p := range policies {
+		for k, v := range p.Spec.ForcedAnnotations {
+			if GetAnnotation(ac, k) != v {
+				errList = append(errList, field.Invalid(field.NewPath("metadata", "annotations").Key(LabelPrefix+"/"+k), GetAnnotation(ac, k),
+					fmt.Sprintf("must be %q by appPolicy %s", v, p.Name)))
+			}
+		}
+		if ac.Spec.Ingress.Enable && len(p.Spec.AllowedIngressHosts) > 0 && !matchHost(ac.Spec.Ingress.Host, p.Spec.AllowedIngressHosts) {
+			errList = append(errList, field.NotSupported(field.NewPath("spec", "ingress", "host"), ac.Spec.Ingress.Host, p.Spec.AllowedIngressHosts))
+		}
+		if p.Spec.ImagePolicy != nil {
+			for i, dc := range ac.Spec.DeployConfigs {
+				if err := p.Spec.ImagePolicy.Validate(dc.Image); err != nil {
+					errList = append(errList, field.Invalid(field.NewPath("spec", "deployConfigs").Index(i).Child("image"), dc.Image,
+						fmt.Sprintf("%s by appPolicy %s", err.Error(), p.Name)))
+				}
+			}
+		}
+		if p.Spec.MaxReplicas != nil {
+			for i := range ac.Spec.DeployConfigs {
+				dc := &ac.Spec.DeployConfigs[i]
+				// canary 按百分比设置时检查计算后的副本数
+				replicas := ac.GetDesiredReplicas(dc)
+				if replicas <= *p.Spec.MaxReplicas {
+					continue
+				}
+				path := field.NewPath("spec", "deployConfigs").Index(i)
+				if dc.Type == CanaryDeploy && dc.ReplicasPercent != nil {
+					errList = append(errList, field.Invalid(path.Child("replicasPercent"), *dc.ReplicasPercent,
+						fmt.Sprintf("resolves to %d replicas, must be no more than %d by appPolicy %s", replicas, *p.Spec.MaxReplicas, p.Name)))
+					continue
+				}
+				errList = append(errList, field.Invalid(path.Child("replicas"), replicas,
+					fmt.Sprintf("must be no more than %d by appPolicy %s", *p.Spec.MaxReplicas, p.Name)))
+			}
+		}
+	}
+	return errList
+}
+
+// Validate 检查镜像是否满足约束
+func (p *ImagePolicy) Validate(image string) error {
+	ref := ParseImage(image)
+	if len(p.AllowedRegistries) > 0 && !containsString(p.AllowedRegistries, ref.Registry) {
+		return fmt.Errorf("registry %s is not allowed", ref.Registry)
+	}
+	if ref.Tag != NilValue && containsString(p.DeniedTags, ref.Tag) {
+		return fmt.Errorf("tag %s is denied", ref.Tag)
+	}
+	hasDigest := ref.Digest != NilValue
+	hasSemver := IsSemverTag(ref.Tag)
+	switch {
+	case p.RequireDigest && p.RequireSemverTag:
+		if !hasDigest && !hasSemver {
+			return fmt.Errorf("digest or semver tag is required")
+		}
+	case p.RequireDigest:
+		if !hasDigest {
+			return fmt.Errorf("digest is required")
+		}
+	case p.RequireSemverTag:
+		if !hasSemver {
+			return fmt.Errorf("semver tag is required")
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(host string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == host {
+			return true
+		}
+		if strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:]) {
+			// 通配只匹配一级子域名
+			sub := strings.TrimSuffix(host, a[1:])
+			if sub != NilValue && !strings.Contains(sub, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
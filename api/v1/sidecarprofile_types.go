@@ -0,0 +1,50 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SidecarProfileSpec defines the desired state of SidecarProfile
+type SidecarProfileSpec struct {
+	Injection `json:",inline"`
+}
+
+//+kubebuilder:object:root=true
+
+// SidecarProfile is the Schema for the sidecarprofiles API
+// 集中管理注入到 Pod 的容器，AppConfig 通过 sidecar-profile 注解引用，命名空间通过同名注解设置默认值
+type SidecarProfile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SidecarProfileSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SidecarProfileList contains a list of SidecarProfile
+type SidecarProfileList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SidecarProfile `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SidecarProfile{}, &SidecarProfileList{})
+}
@@ -7,14 +7,22 @@ const (
 	CanaryDeploy DeployType = "canary"
 )
 
+type WorkloadKind string
+
+const (
+	DeploymentWorkload  WorkloadKind = "Deployment"
+	StatefulSetWorkload WorkloadKind = "StatefulSet"
+)
+
 const (
-	TureValue    = "true"
-	FalseValue   = "false"
-	NilValue     = ""
-	LabelPrefix  = "app.sanmuyan.com"
-	OperatorName = "app-operator"
-	ApiKind      = "AppConfig"
-	AppName      = "app"
+	TureValue     = "true"
+	FalseValue    = "false"
+	NilValue      = ""
+	DisabledValue = "disabled"
+	LabelPrefix   = "app.sanmuyan.com"
+	OperatorName  = "app-operator"
+	ApiKind       = "AppConfig"
+	AppName       = "app"
 )
 
 const (
@@ -23,7 +31,14 @@ const (
 
 // 标签列表
 const (
+	// InjectionLabel 由 operator 管理的 Pod，webhook 会为其注入容器
 	InjectionLabel = "injection"
+	// HookLabel hook Job 对应的 hook 名称
+	HookLabel = "hook"
+	// RevisionLabel hook Job 对应的镜像版本
+	RevisionLabel = "revision"
+	// ConfigLabel 配置文件 ConfigMap 对应的 AppConfig 名称
+	ConfigLabel    = "config"
 	CreatedByLabel = "app.kubernetes.io/created-by"
 )
 
@@ -41,21 +56,75 @@ const (
 	StrictReleaseAnnotation = "strict-release"
 	// CanaryIngressAnnotation 启用 canary ingress
 	CanaryIngressAnnotation = "canary-ingress"
-	// CanaryRollingWeightAnnotation 在发布中实时切换 canary ingress 的权重
+	// CanaryIdleAnnotation 默认 canary 和 stable 镜像相同并且发布完成后把 canary 缩容到 0 并删除 canary ingress，设置为 false 时关闭
+	CanaryIdleAnnotation = "canary-idle"
+	// CanaryRollingWeightAnnotation 在发布中按 canary 可用副本的占比实时切换 canary ingress 的权重
 	CanaryRollingWeightAnnotation = "canary-rolling-weight"
+	// CanaryRollingMinWeightAnnotation 滚动权重的下限，默认 0
+	CanaryRollingMinWeightAnnotation = "canary-rolling-min-weight"
+	// CanaryRollingMaxWeightAnnotation 滚动权重的上限，默认 100
+	CanaryRollingMaxWeightAnnotation = "canary-rolling-max-weight"
+	// CanaryRollingWeightStepAnnotation 每个间隔（10s）权重最多变化的值，用于平滑切换，默认 100
+	CanaryRollingWeightStepAnnotation = "canary-rolling-weight-step"
+	// CanaryWeightUpdatedAnnotation canary ingress 上记录的滚动权重上一次变化的时间
+	CanaryWeightUpdatedAnnotation = "canary-weight-updated"
 	// IngressAnnotationsAnnotation ingress 追加的 annotations
 	IngressAnnotationsAnnotation = "ingress-annotations"
+	// SidecarProfileAnnotation 引用的 SidecarProfile 名称，可以设置在 AppConfig 或命名空间上
+	SidecarProfileAnnotation = "sidecar-profile"
+	// InjectedProfileAnnotation webhook 注入到 Pod 的 SidecarProfile 名称
+	InjectedProfileAnnotation = "injected-profile"
+	// InjectedProfileVersionAnnotation webhook 注入到 Pod 的 SidecarProfile 版本（generation）
+	InjectedProfileVersionAnnotation = "injected-profile-version"
+	// ConfigHashAnnotation pod 模板上引用的 ConfigMap/Secret 内容哈希
+	ConfigHashAnnotation = "config-hash"
+	// ManagedEnvAnnotation 工作负载上记录的上次设置到 app 容器的 env 名称和 envFrom，用于删除配置中去掉的条目，值是 JSON
+	ManagedEnvAnnotation = "managed-env"
+	// PodSpecHashAnnotation CronJob 上记录的渲染后 Pod 配置的哈希，变化时才替换 Pod 配置，保留 API server 设置的默认值
+	PodSpecHashAnnotation = "pod-spec-hash"
+	// ActionAnnotation 手动发布操作，处理后被移除，值是 promote abort retry skip-analysis 之一
+	ActionAnnotation = "action"
+	// ActionByAnnotation 发布操作的执行人，由 webhook 设置为修改 action 注解的用户
+	ActionByAnnotation = "action-by"
+	// ResolveDigestAnnotation 发布前把镜像 tag 解析为 digest 并固定到 Deployment
+	ResolveDigestAnnotation = "resolve-digest"
+)
+
+// 状态条件
+const (
+	// ReadyCondition 所属资源已经调谐到期望状态
+	ReadyCondition = "Ready"
+)
+
+// 状态条件原因
+const (
+	ReconciledReason           = "Reconciled"
+	ProgressingReason          = "Progressing"
+	PausedReason               = "Paused"
+	FrozenReason               = "Frozen"
+	InvalidConfigReason        = "InvalidConfig"
+	DeleteProtectedReason      = "DeleteProtected"
+	PolicyViolationReason      = "PolicyViolation"
+	HookFailedReason           = "HookFailed"
+	RegistryUnauthorizedReason = "RegistryUnauthorized"
 )
 
 // 消息列表
 const (
-	DeleteProtectedMessage  = "cannot delete protected resources"
-	VersionNotLatestMessage = "latest version and try again"
+	DeleteProtectedMessage = "cannot delete protected resources"
+)
+
+// 字段路径
+const (
+	// ProtectedFieldPath 删除保护拒绝时返回的字段路径
+	ProtectedFieldPath = "metadata.annotations"
 )
 
 // 第三方注解
 const (
-	NginxIngressAnnotationPrefix = "nginx.ingress.kubernetes.io"
-	NginxIngressCanaryAnnotation = NginxIngressAnnotationPrefix + "/canary"
-	NginxIngressWeightAnnotation = NginxIngressAnnotationPrefix + "canary-weight"
+	NginxIngressAnnotationPrefix     = "nginx.ingress.kubernetes.io"
+	NginxIngressCanaryAnnotation     = NginxIngressAnnotationPrefix + "/canary"
+	NginxIngressWeightAnnotation     = NginxIngressAnnotationPrefix + "/canary-weight"
+	NginxIngressMirrorAnnotation     = NginxIngressAnnotationPrefix + "/mirror-target"
+	NginxIngressMirrorHostAnnotation = NginxIngressAnnotationPrefix + "/mirror-host"
 )
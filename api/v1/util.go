@@ -32,6 +32,16 @@ func AddLabel(o metav1.Object, k, v string) {
 	o.GetLabels()[LabelPrefix+"/"+k] = v
 }
 
+func GetLabel(o metav1.Object, k string) string {
+	if o.GetLabels() == nil {
+		return ""
+	}
+	if label, ok := o.GetLabels()[LabelPrefix+"/"+k]; ok {
+		return label
+	}
+	return ""
+}
+
 func GetAnnotation(o metav1.Object, k string) string {
 	if o.GetAnnotations() == nil {
 		return ""
@@ -0,0 +1,213 @@
+// kubectl-appconfig AppConfig 的 kubectl 插件，放到 PATH 中后通过 kubectl appconfig 使用
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appv1 "sanmuyan.com/app-operator/api/v1"
+)
+
+// fieldOwner 插件修改 AppConfig 时使用的 field manager
+const fieldOwner = "kubectl-appconfig"
+
+const usage = `Manage AppConfig rollouts.
+
+Usage:
+  kubectl appconfig <command> <name> [flags]
+
+Commands:
+  status <name>                          Show images, ready/desired replicas, canary weight and conditions
+  promote <name>                         Update the stable image to the canary image
+  abort <name>                           Roll the canary image back to the stable image
+  pause <name>                           Pause the rollout
+  resume <name>                          Resume the rollout
+  set-image <name> <deploy>=<image> ...  Update images, <deploy> is a deployConfig name or type (stable, canary)
+  history <name>                         Show the recorded rollout actions
+
+Flags:
+`
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(appv1.AddToScheme(scheme))
+}
+
+func main() {
+	if err := run(context.Background(), os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, out, errOut io.Writer) error {
+	fs := flag.NewFlagSet("kubectl-appconfig", flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	overrides := &clientcmd.ConfigOverrides{}
+	fs.StringVar(&loadingRules.ExplicitPath, "kubeconfig", "", "Path to the kubeconfig file.")
+	fs.StringVar(&overrides.CurrentContext, "context", "", "The kubeconfig context to use.")
+	fs.StringVar(&overrides.Context.Namespace, "namespace", "", "The namespace of the AppConfig.")
+	fs.StringVar(&overrides.Context.Namespace, "n", "", "The namespace of the AppConfig (shorthand).")
+	fs.Usage = func() {
+		fmt.Fprint(errOut, usage)
+		fs.PrintDefaults()
+	}
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if len(positional) < 2 {
+		fs.Usage()
+		return errors.New("command and AppConfig name are required")
+	}
+	command, name, rest := positional[0], positional[1], positional[2:]
+
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return err
+	}
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return err
+	}
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	cli := &cli{client: c, namespace: namespace, out: out}
+
+	if command != "set-image" && len(rest) > 0 {
+		return fmt.Errorf("unexpected arguments %v", rest)
+	}
+	switch command {
+	case "status":
+		return cli.status(ctx, name)
+	case "promote":
+		return cli.action(ctx, name, appv1.PromoteAction)
+	case "abort":
+		return cli.action(ctx, name, appv1.AbortAction)
+	case "pause":
+		return cli.setPaused(ctx, name, true)
+	case "resume":
+		return cli.setPaused(ctx, name, false)
+	case "set-image":
+		return cli.setImage(ctx, name, rest)
+	case "history":
+		return cli.history(ctx, name)
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// parseArgs 允许参数和 flag 混合出现，返回所有非 flag 参数
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// cli 插件命令的实现
+type cli struct {
+	client    client.Client
+	namespace string
+	out       io.Writer
+}
+
+func (c *cli) get(ctx context.Context, name string) (*appv1.AppConfig, error) {
+	ac := &appv1.AppConfig{}
+	if err := c.client.Get(ctx, client.ObjectKey{Namespace: c.namespace, Name: name}, ac); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
+// action 设置 action 注解，由 controller 执行并记录到 status.actions
+func (c *cli) action(ctx context.Context, name string, action appv1.Action) error {
+	ac, err := c.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFromWithOptions(ac.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	appv1.AddAnnotation(ac, appv1.ActionAnnotation, string(action))
+	if err := c.client.Patch(ctx, ac, patch, client.FieldOwner(fieldOwner)); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "appconfig/%s %s requested\n", name, action)
+	return nil
+}
+
+func (c *cli) setPaused(ctx context.Context, name string, paused bool) error {
+	ac, err := c.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	state := "resumed"
+	if paused {
+		state = "paused"
+	}
+	if ac.Spec.Paused == paused {
+		fmt.Fprintf(c.out, "appconfig/%s already %s\n", name, state)
+		return nil
+	}
+	patch := client.MergeFromWithOptions(ac.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	ac.Spec.Paused = paused
+	if err := c.client.Patch(ctx, ac, patch, client.FieldOwner(fieldOwner)); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "appconfig/%s %s\n", name, state)
+	return nil
+}
+
+// setImage 参数格式为 <deploy>=<image>，deploy 可以是 deployConfig 名称或类型
+func (c *cli) setImage(ctx context.Context, name string, images []string) error {
+	if len(images) == 0 {
+		return errors.New("at least one <deploy>=<image> is required")
+	}
+	ac, err := c.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFromWithOptions(ac.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	for _, arg := range images {
+		deploy, image, ok := cutImageArg(arg)
+		if !ok {
+			return fmt.Errorf("invalid image %q, expected <deploy>=<image>", arg)
+		}
+		i := findDeployConfig(ac, deploy)
+		if i < 0 {
+			return fmt.Errorf("deployConfig %q not found in appconfig/%s", deploy, name)
+		}
+		ac.Spec.DeployConfigs[i].Image = image
+	}
+	if err := c.client.Patch(ctx, ac, patch, client.FieldOwner(fieldOwner)); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "appconfig/%s image updated\n", name)
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	appv1 "sanmuyan.com/app-operator/api/v1"
+)
+
+func TestCli(t *testing.T) {
+	newAppConfig := func() *appv1.AppConfig {
+		ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+		ac.Spec.Ingress.Enable = true
+		ac.Spec.DeployConfigs = []appv1.DeployConfig{
+			{Name: "demo", Type: appv1.StableDeploy, Image: "app:v1"},
+			{Name: "demo-canary", Type: appv1.CanaryDeploy, Image: "app:v2"},
+		}
+		ac.Status.DeployStatus = []appv1.DeployStatus{
+			{Type: appv1.StableDeploy, Image: "app:v1", AvailableReplicas: 1, DesiredReplicas: 1},
+			{Type: appv1.CanaryDeploy, Image: "app:v2", AvailableReplicas: 0, DesiredReplicas: 1},
+		}
+		ac.Status.Actions = []appv1.ActionRecord{{Action: appv1.PromoteAction, User: "alice", Succeeded: true, Message: "update demo image"}}
+		return ac
+	}
+	ingress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "demo-canary", Namespace: "default", Annotations: map[string]string{
+		appv1.NginxIngressCanaryAnnotation: appv1.TureValue,
+		appv1.NginxIngressWeightAnnotation: "25",
+	}}}
+
+	tests := []struct {
+		name       string
+		run        func(c *cli) error
+		wantErr    bool
+		wantOutput []string
+		check      func(t *testing.T, ac *appv1.AppConfig)
+	}{
+		{
+			name:       "status",
+			run:        func(c *cli) error { return c.status(context.Background(), "demo") },
+			wantOutput: []string{"demo-canary", "app:v2", "0/1", "25%"},
+		},
+		{
+			name:       "history",
+			run:        func(c *cli) error { return c.history(context.Background(), "demo") },
+			wantOutput: []string{"promote", "alice", "Succeeded"},
+		},
+		{
+			name: "promote",
+			run:  func(c *cli) error { return c.action(context.Background(), "demo", appv1.PromoteAction) },
+			check: func(t *testing.T, ac *appv1.AppConfig) {
+				if action := appv1.GetAnnotation(ac, appv1.ActionAnnotation); action != string(appv1.PromoteAction) {
+					t.Errorf("action = %q, want promote", action)
+				}
+			},
+		},
+		{
+			name: "pause",
+			run:  func(c *cli) error { return c.setPaused(context.Background(), "demo", true) },
+			check: func(t *testing.T, ac *appv1.AppConfig) {
+				if !ac.Spec.Paused {
+					t.Error("appconfig not paused")
+				}
+			},
+		},
+		{
+			name: "set image by type and name",
+			run: func(c *cli) error {
+				return c.setImage(context.Background(), "demo", []string{"canary=app:v3", "demo=app:v2"})
+			},
+			check: func(t *testing.T, ac *appv1.AppConfig) {
+				if ac.Spec.DeployConfigs[0].Image != "app:v2" || ac.Spec.DeployConfigs[1].Image != "app:v3" {
+					t.Errorf("images = %s/%s, want app:v2/app:v3", ac.Spec.DeployConfigs[0].Image, ac.Spec.DeployConfigs[1].Image)
+				}
+			},
+		},
+		{
+			name:    "set image unknown deploy",
+			run:     func(c *cli) error { return c.setImage(context.Background(), "demo", []string{"missing=app:v3"}) },
+			wantErr: true,
+		},
+		{
+			name:    "set image invalid argument",
+			run:     func(c *cli) error { return c.setImage(context.Background(), "demo", []string{"app:v3"}) },
+			wantErr: true,
+		},
+		{
+			name:    "missing appconfig",
+			run:     func(c *cli) error { return c.status(context.Background(), "missing") },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			c := &cli{
+				client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(newAppConfig(), ingress.DeepCopy()).Build(),
+				namespace: "default",
+				out:       out,
+			}
+			err := tt.run(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, s := range tt.wantOutput {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("output does not contain %q:\n%s", s, out.String())
+				}
+			}
+			if tt.check != nil {
+				ac := &appv1.AppConfig{}
+				if err := c.client.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "demo"}, ac); err != nil {
+					t.Fatal(err)
+				}
+				tt.check(t, ac)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appv1 "sanmuyan.com/app-operator/api/v1"
+)
+
+// status 输出发布视图：每个 deployConfig 的镜像、就绪副本、canary 权重以及 AppConfig 的状态
+func (c *cli) status(ctx context.Context, name string) error {
+	ac, err := c.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Name:       %s\n", ac.Name)
+	fmt.Fprintf(c.out, "Namespace:  %s\n", ac.Namespace)
+	fmt.Fprintf(c.out, "Paused:     %t\n", ac.Spec.Paused)
+	if ac.Status.FrozenUntil != nil {
+		fmt.Fprintf(c.out, "Frozen:     %s\n", appv1.FormatFrozenUntil(ac.Status.FrozenUntil.Time))
+	}
+	if m := ac.Status.Mirror; m != nil {
+		fmt.Fprintf(c.out, "Mirror:     %s active=%t target=%s percent=%d\n", m.Provider, m.Active, m.Target, m.Percent)
+	}
+
+	fmt.Fprintln(c.out, "\nDeploy:")
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  NAME\tTYPE\tKIND\tIMAGE\tRUNNING\tREADY\tWEIGHT")
+	for _, dc := range ac.Spec.DeployConfigs {
+		ds := getDeployStatus(ac, dc.Type)
+		running := ds.Image
+		if ds.PendingImage != appv1.NilValue {
+			running += " (pending " + ds.PendingImage + ")"
+		}
+		if ds.Idle {
+			running += " (idle)"
+		}
+		desired := ds.DesiredReplicas
+		if desired == 0 && !ds.Idle {
+			desired = dc.GetReplicas()
+		}
+		weight, err := c.canaryWeight(ctx, ac, &dc)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%d/%d\t%s\n", dc.Name, dc.Type, dc.GetWorkloadKind(),
+			dc.Image, orNone(running), ds.AvailableReplicas, desired, weight)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.out, "\nConditions:")
+	w = tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  TYPE\tSTATUS\tREASON\tAGE\tMESSAGE")
+	for _, cond := range ac.Status.Conditions {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", cond.Type, cond.Status, cond.Reason, age(cond.LastTransitionTime.Time), cond.Message)
+	}
+	return w.Flush()
+}
+
+// canaryWeight 读取 canary ingress 的 nginx 权重，没有 canary ingress 时返回 -
+func (c *cli) canaryWeight(ctx context.Context, ac *appv1.AppConfig, dc *appv1.DeployConfig) (string, error) {
+	if dc.Type != appv1.CanaryDeploy || !ac.Spec.Ingress.Enable {
+		return "-", nil
+	}
+	ingress := &networkingv1.Ingress{}
+	if err := c.client.Get(ctx, client.ObjectKey{Namespace: ac.Namespace, Name: dc.Name}, ingress); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "-", nil
+		}
+		return "", err
+	}
+	if ingress.Annotations[appv1.NginxIngressCanaryAnnotation] != appv1.TureValue {
+		return "-", nil
+	}
+	weight := ingress.Annotations[appv1.NginxIngressWeightAnnotation]
+	if weight == appv1.NilValue {
+		weight = "0"
+	}
+	return weight + "%", nil
+}
+
+// history 输出 status.actions 中的发布操作记录
+func (c *cli) history(ctx context.Context, name string) error {
+	ac, err := c.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(ac.Status.Actions) == 0 {
+		fmt.Fprintf(c.out, "No actions recorded for appconfig/%s\n", name)
+		return nil
+	}
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTION\tUSER\tRESULT\tMESSAGE")
+	for _, record := range ac.Status.Actions {
+		result := "Failed"
+		if record.Succeeded {
+			result = "Succeeded"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", record.Time.Format(time.RFC3339), record.Action, record.User, result, record.Message)
+	}
+	return w.Flush()
+}
+
+func getDeployStatus(ac *appv1.AppConfig, t appv1.DeployType) appv1.DeployStatus {
+	for _, ds := range ac.Status.DeployStatus {
+		if ds.Type == t {
+			return ds
+		}
+	}
+	return appv1.DeployStatus{}
+}
+
+// findDeployConfig 按名称或类型查找 deployConfig
+func findDeployConfig(ac *appv1.AppConfig, deploy string) int {
+	for i, dc := range ac.Spec.DeployConfigs {
+		if dc.Name == deploy || string(dc.Type) == deploy {
+			return i
+		}
+	}
+	return -1
+}
+
+func cutImageArg(arg string) (deploy, image string, ok bool) {
+	deploy, image, ok = strings.Cut(arg, "=")
+	return deploy, image, ok && deploy != appv1.NilValue && image != appv1.NilValue
+}
+
+func orNone(s string) string {
+	if s == appv1.NilValue {
+		return "<none>"
+	}
+	return s
+}
+
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "<unknown>"
+	}
+	return time.Since(t).Round(time.Second).String()
+}
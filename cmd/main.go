@@ -19,8 +19,10 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -30,12 +32,15 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	appv1 "sanmuyan.com/app-operator/api/v1"
 	"sanmuyan.com/app-operator/internal/controller"
+	"sanmuyan.com/app-operator/internal/registry"
+	"sanmuyan.com/app-operator/internal/server"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -55,8 +60,20 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var plainHTTPRegistries string
+	var podWebhookFailOpen bool
+	var apiAddr string
+	var apiCertDir string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&plainHTTPRegistries, "plain-http-registries", "",
+		"Comma separated image registries accessed over plain HTTP, localhost and loopback addresses always use plain HTTP.")
+	flag.BoolVar(&podWebhookFailOpen, "pod-webhook-fail-open", false,
+		"Admit pods without injection instead of rejecting them when the pod injection webhook fails.")
+	flag.StringVar(&apiAddr, "api-bind-address", "0",
+		"The address the action and dry-run API binds to. Set this to '0' to disable the API.")
+	flag.StringVar(&apiCertDir, "api-cert-dir", filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs"),
+		"The directory containing tls.crt and tls.key for the API, defaults to the webhook server certificate.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -74,6 +91,8 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "1be29ffd.sanmuyan.com",
+		// ConfigMap/Secret 只缓存 metadata，读取内容时直接访问 API server
+		Client: client.Options{Cache: &client.CacheOptions{DisableFor: controller.UncachedObjects()}},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -91,10 +110,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controller.AppConfigReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	reconciler := &controller.AppConfigReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("appconfig-controller"),
+		Registry: registry.NewClient(strings.Split(plainHTTPRegistries, ",")),
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "AppConfig")
 		os.Exit(1)
 	}
@@ -108,10 +130,24 @@ func main() {
 	// 手动注册 webhook
 	mgr.GetWebhookServer().Register("/mutate-v1-pod",
 		&webhook.Admission{Handler: &appv1.PodAnnotator{
-			Client:  mgr.GetClient(),
-			Decoder: admission.NewDecoder(runtime.NewScheme()),
+			Client:   mgr.GetClient(),
+			Decoder:  admission.NewDecoder(mgr.GetScheme()),
+			FailOpen: podWebhookFailOpen,
 		}})
 
+	// 发布操作和 dryrun API，dryrun 使用 controller 中的全局模板
+	if apiAddr != "0" {
+		if err := mgr.Add(&server.Server{
+			Client:      mgr.GetClient(),
+			BindAddress: apiAddr,
+			CertDir:     apiCertDir,
+			DryRunner:   reconciler,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up api server")
+			os.Exit(1)
+		}
+	}
+
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
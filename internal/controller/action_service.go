@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+// handleAction 执行 action 注解指定的手动发布操作，执行后移除注解，结果记录到状态和事件中
+// 操作本身无法执行时记录为失败，访问 API 出错时返回错误，保留注解等待重试
+func (r *AppConfigReconciler) handleAction(ctx context.Context, ac *appv1.AppConfig) error {
+	action := appv1.Action(appv1.GetAnnotation(ac, appv1.ActionAnnotation))
+	if action == appv1.NilValue {
+		return nil
+	}
+	user := getActionUser(ac)
+	patch := client.MergeFromWithOptions(ac.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	status := ac.Status.DeepCopy()
+	message, actionErr := r.applyAction(ctx, ac, status, action)
+	if actionErr != nil && !isActionFailure(actionErr) {
+		return actionErr
+	}
+	delete(ac.Annotations, appv1.LabelPrefix+"/"+appv1.ActionAnnotation)
+	delete(ac.Annotations, appv1.LabelPrefix+"/"+appv1.ActionByAnnotation)
+	if err := r.Patch(ctx, ac, patch); err != nil {
+		return err
+	}
+
+	record := appv1.ActionRecord{
+		Action:    action,
+		User:      user,
+		Time:      metav1.Now().Rfc3339Copy(),
+		Succeeded: actionErr == nil,
+		Message:   message,
+	}
+	if actionErr != nil {
+		record.Message = actionErr.Error()
+		acLog.Info("action failed", "namespace", ac.Namespace, "name", ac.Name, "action", action, "user", user, "error", actionErr)
+		r.Recorder.Eventf(ac, corev1.EventTypeWarning, "ActionFailed", "%s by %s failed: %s", action, user, record.Message)
+	} else {
+		acLog.Info("action succeeded", "namespace", ac.Namespace, "name", ac.Name, "action", action, "user", user, "message", message)
+		r.Recorder.Eventf(ac, corev1.EventTypeNormal, "ActionSucceeded", "%s by %s: %s", action, user, message)
+	}
+	status.Actions = append(status.Actions, record)
+	if len(status.Actions) > maxActionRecords {
+		status.Actions = status.Actions[len(status.Actions)-maxActionRecords:]
+	}
+	return r.patchStatus(ctx, ac, *status)
+}
+
+// applyAction 修改内存中的 spec 和 status，返回执行结果
+func (r *AppConfigReconciler) applyAction(ctx context.Context, ac *appv1.AppConfig, status *appv1.AppConfigStatus, action appv1.Action) (string, error) {
+	stable := getDeployConfigIndex(ac, appv1.StableDeploy)
+	canary := getDeployConfigIndex(ac, appv1.CanaryDeploy)
+	switch action {
+	case appv1.PromoteAction, appv1.AbortAction:
+		if stable < 0 || canary < 0 {
+			return "", newActionFailure("%s requires both stable and canary deployConfigs", action)
+		}
+		from, to := canary, stable
+		if action == appv1.AbortAction {
+			from, to = stable, canary
+		}
+		image := ac.Spec.DeployConfigs[from].Image
+		old := ac.Spec.DeployConfigs[to].Image
+		status.SkipAnalysisImage = appv1.NilValue
+		if old == image {
+			return fmt.Sprintf("%s already runs image %s", ac.Spec.DeployConfigs[to].Name, image), nil
+		}
+		ac.Spec.DeployConfigs[to].Image = image
+		return fmt.Sprintf("update %s image from %s to %s", ac.Spec.DeployConfigs[to].Name, old, image), nil
+	case appv1.RetryAction:
+		jobs, err := r.deleteFailedHookJobs(ctx, ac)
+		if err != nil {
+			return "", err
+		}
+		var hooks []appv1.HookStatus
+		for _, hs := range status.Hooks {
+			if hs.Result != appv1.HookFailed {
+				hooks = append(hooks, hs)
+			}
+		}
+		status.Hooks = hooks
+		if len(jobs) == 0 {
+			return "no failed hook, reconcile again", nil
+		}
+		return "retry failed hook jobs " + strings.Join(jobs, ","), nil
+	case appv1.SkipAnalysisAction:
+		if canary < 0 {
+			return "", newActionFailure("%s requires a canary deployConfig", action)
+		}
+		status.SkipAnalysisImage = ac.Spec.DeployConfigs[canary].Image
+		return "skip canary analysis for image " + status.SkipAnalysisImage, nil
+	}
+	return "", newActionFailure("unsupported action %q", action)
+}
+
+// deleteFailedHookJobs 删除失败的 hook Job，下次调谐时重新创建
+func (r *AppConfigReconciler) deleteFailedHookJobs(ctx context.Context, ac *appv1.AppConfig) ([]string, error) {
+	jobList := &batchv1.JobList{}
+	if err := r.List(ctx, jobList, client.InNamespace(ac.Namespace), client.MatchingFields{ownerKey: ac.Name}); err != nil {
+		return nil, err
+	}
+	var jobs []string
+	for i := range jobList.Items {
+		job := &jobList.Items[i]
+		if getHookResult(job) != appv1.HookFailed {
+			continue
+		}
+		if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job.Name)
+	}
+	return jobs, nil
+}
+
+// actionFailure 操作本身无法执行，不需要重试
+type actionFailure struct {
+	msg string
+}
+
+func (e *actionFailure) Error() string {
+	return e.msg
+}
+
+func newActionFailure(format string, args ...interface{}) error {
+	return &actionFailure{msg: fmt.Sprintf(format, args...)}
+}
+
+func isActionFailure(err error) bool {
+	_, ok := err.(*actionFailure)
+	return ok
+}
+
+func getDeployConfigIndex(ac *appv1.AppConfig, t appv1.DeployType) int {
+	for i := range ac.Spec.DeployConfigs {
+		if ac.Spec.DeployConfigs[i].Type == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// getActionUser 返回操作的执行人，action-by 注解由 webhook 按请求的用户设置
+func getActionUser(ac *appv1.AppConfig) string {
+	if user := appv1.GetAnnotation(ac, appv1.ActionByAnnotation); user != appv1.NilValue {
+		return user
+	}
+	return "unknown"
+}
+
+// isSkipAnalysis 当前 canary 镜像是否执行过 skip-analysis，解析 digest 后的镜像同样匹配
+func isSkipAnalysis(ac *appv1.AppConfig) bool {
+	canary, ok := ac.GetDeployConfig(appv1.CanaryDeploy)
+	if !ok || ac.Status.SkipAnalysisImage == appv1.NilValue {
+		return false
+	}
+	return canary.Image == ac.Status.SkipAnalysisImage || strings.HasPrefix(canary.Image, ac.Status.SkipAnalysisImage+"@")
+}
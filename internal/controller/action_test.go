@@ -0,0 +1,181 @@
+package controller
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestHandleAction(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	newAppConfig := func(action, user string, withCanary bool) *appv1.AppConfig {
+		ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+		ac.Spec.DeployConfigs = []appv1.DeployConfig{{Name: "demo", Type: appv1.StableDeploy, Image: "app:v1"}}
+		if withCanary {
+			ac.Spec.DeployConfigs = append(ac.Spec.DeployConfigs, appv1.DeployConfig{Name: "demo-canary", Type: appv1.CanaryDeploy, Image: "app:v2"})
+		}
+		ac.Status.Hooks = []appv1.HookStatus{{Name: "migrate", Phase: appv1.PreHook, Result: appv1.HookFailed}}
+		if action != "" {
+			appv1.AddAnnotation(ac, appv1.ActionAnnotation, action)
+		}
+		if user != "" {
+			appv1.AddAnnotation(ac, appv1.ActionByAnnotation, user)
+		}
+		return ac
+	}
+
+	tests := []struct {
+		name          string
+		ac            *appv1.AppConfig
+		failedJob     bool
+		wantStable    string
+		wantCanary    string
+		wantRecord    bool
+		wantSucceeded bool
+		wantUser      string
+		wantSkip      string
+		wantHooks     int
+	}{
+		{
+			name:       "no action",
+			ac:         newAppConfig("", "", true),
+			wantStable: "app:v1",
+			wantCanary: "app:v2",
+			wantHooks:  1,
+		},
+		{
+			name:          "promote",
+			ac:            newAppConfig(string(appv1.PromoteAction), "alice", true),
+			wantStable:    "app:v2",
+			wantCanary:    "app:v2",
+			wantRecord:    true,
+			wantSucceeded: true,
+			wantUser:      "alice",
+			wantHooks:     1,
+		},
+		{
+			name:          "abort",
+			ac:            newAppConfig(string(appv1.AbortAction), "", true),
+			wantStable:    "app:v1",
+			wantCanary:    "app:v1",
+			wantRecord:    true,
+			wantSucceeded: true,
+			wantUser:      "unknown",
+			wantHooks:     1,
+		},
+		{
+			name:       "promote without canary",
+			ac:         newAppConfig(string(appv1.PromoteAction), "alice", false),
+			wantStable: "app:v1",
+			wantRecord: true,
+			wantUser:   "alice",
+			wantHooks:  1,
+		},
+		{
+			name:          "skip analysis",
+			ac:            newAppConfig(string(appv1.SkipAnalysisAction), "alice", true),
+			wantStable:    "app:v1",
+			wantCanary:    "app:v2",
+			wantRecord:    true,
+			wantSucceeded: true,
+			wantUser:      "alice",
+			wantSkip:      "app:v2",
+			wantHooks:     1,
+		},
+		{
+			name:          "retry",
+			ac:            newAppConfig(string(appv1.RetryAction), "alice", true),
+			failedJob:     true,
+			wantStable:    "app:v1",
+			wantCanary:    "app:v2",
+			wantRecord:    true,
+			wantSucceeded: true,
+			wantUser:      "alice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []client.Object{tt.ac}
+			if tt.failedJob {
+				job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "demo-hook-migrate", Namespace: "default"}}
+				job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+				if err := ctrl.SetControllerReference(tt.ac, job, s); err != nil {
+					t.Fatal(err)
+				}
+				objects = append(objects, job)
+			}
+			c := fake.NewClientBuilder().WithScheme(s).WithObjects(objects...).
+				WithStatusSubresource(&appv1.AppConfig{}).
+				WithIndex(&batchv1.Job{}, ownerKey, func(obj client.Object) []string {
+					if owner := metav1.GetControllerOf(obj); owner != nil {
+						return []string{owner.Name}
+					}
+					return nil
+				}).Build()
+			r := &AppConfigReconciler{Client: c, Scheme: s, Recorder: record.NewFakeRecorder(10)}
+
+			ac := &appv1.AppConfig{}
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(tt.ac), ac); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.handleAction(context.Background(), ac); err != nil {
+				t.Fatal(err)
+			}
+
+			got := &appv1.AppConfig{}
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(tt.ac), got); err != nil {
+				t.Fatal(err)
+			}
+			if appv1.GetAnnotation(got, appv1.ActionAnnotation) != "" || appv1.GetAnnotation(got, appv1.ActionByAnnotation) != "" {
+				t.Errorf("action annotations not removed: %v", got.Annotations)
+			}
+			stable, _ := got.GetDeployConfig(appv1.StableDeploy)
+			canary, _ := got.GetDeployConfig(appv1.CanaryDeploy)
+			if stable.Image != tt.wantStable || canary.Image != tt.wantCanary {
+				t.Errorf("images = %s/%s, want %s/%s", stable.Image, canary.Image, tt.wantStable, tt.wantCanary)
+			}
+			if got.Status.SkipAnalysisImage != tt.wantSkip {
+				t.Errorf("skipAnalysisImage = %q, want %q", got.Status.SkipAnalysisImage, tt.wantSkip)
+			}
+			if len(got.Status.Hooks) != tt.wantHooks {
+				t.Errorf("got %d hook statuses, want %d", len(got.Status.Hooks), tt.wantHooks)
+			}
+			if !tt.wantRecord {
+				if len(got.Status.Actions) != 0 {
+					t.Errorf("unexpected action records %v", got.Status.Actions)
+				}
+				return
+			}
+			if len(got.Status.Actions) != 1 {
+				t.Fatalf("got %d action records, want 1", len(got.Status.Actions))
+			}
+			record := got.Status.Actions[0]
+			if record.Succeeded != tt.wantSucceeded || record.User != tt.wantUser {
+				t.Errorf("record = %+v, want succeeded %v user %s", record, tt.wantSucceeded, tt.wantUser)
+			}
+			if tt.failedJob {
+				err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "demo-hook-migrate"}, &batchv1.Job{})
+				if !apierrors.IsNotFound(err) {
+					t.Errorf("failed hook job not deleted: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -19,30 +19,48 @@ package controller
 import (
 	"context"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sanmuyan.com/app-operator/internal/registry"
 )
 
 // AppConfigReconciler reconciles a AppConfig object
 type AppConfigReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Registry *registry.Client
+	// dryRun 模拟调谐时记录结果
+	dryRun *DryRunResult
 }
 
 //+kubebuilder:rbac:groups=app.sanmuyan.com,resources=appconfigs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=app.sanmuyan.com,resources=appconfigs/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=app.sanmuyan.com,resources=appconfigs/finalizers,verbs=update
+//+kubebuilder:rbac:groups=app.sanmuyan.com,resources=apppolicies,verbs=get;list;watch
 //+kubebuilder:rbac:groups=*,resources=deployments,verbs=*
+//+kubebuilder:rbac:groups=*,resources=statefulsets,verbs=*
+//+kubebuilder:rbac:groups=*,resources=cronjobs,verbs=*
+//+kubebuilder:rbac:groups=*,resources=jobs,verbs=*
 //+kubebuilder:rbac:groups=*,resources=services,verbs=*
 //+kubebuilder:rbac:groups=*,resources=ingresses,verbs=*
 //+kubebuilder:rbac:groups=*,resources=configmaps,verbs=*
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -62,41 +80,125 @@ func (r *AppConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	ac := &appv1.AppConfig{}
 	if err := r.Get(ctx, req.NamespacedName, ac); err != nil {
 		acLog.Info("failed to get appConfig", "namespace", req.Namespace, "name", req.Name, "error", err)
-		return ctrl.Result{}, ignoreError(err)
+		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
 	// 添加 finalizer
 	if err := r.updateFinalizer(ctx, ac); err != nil {
 		acLog.Info("failed to update finalizer", "namespace", req.Namespace, "name", req.Name, "error", err)
-		return ctrl.Result{}, ignoreError(err)
+		return r.handleError(ctx, ac, err)
 	}
 	if !ac.DeletionTimestamp.IsZero() {
 		return ctrl.Result{}, nil
 	}
 
-	// 判断是否处于暂停状态
-	if ac.Spec.Paused {
-		acLog.Info("appConfig is paused, skip update", "namespace", req.Namespace, "name", req.Name)
-		return ctrl.Result{}, nil
+	// 读取全局模板
+	if err := r.loadTemplate(ctx); err != nil {
+		acLog.Info("failed to load template", "namespace", req.Namespace, "name", req.Name, "error", err)
+		return r.handleError(ctx, ac, err)
+	}
+
+	// 执行手动发布操作
+	if err := r.handleAction(ctx, ac); err != nil {
+		acLog.Info("failed to handle action", "namespace", req.Namespace, "name", req.Name, "error", err)
+		return r.handleError(ctx, ac, err)
+	}
+
+	// 镜像自动更新，发现新的 tag 时更新 canary 的镜像
+	watchRequeue, err := r.watchImages(ctx, ac)
+	if err != nil {
+		acLog.Info("failed to watch image", "namespace", req.Namespace, "name", req.Name, "error", err)
+		return r.handleError(ctx, ac, err)
+	}
+
+	// 应用命名空间的 AppPolicy，只在内存中生效，不写回 AppConfig
+	if err := r.applyPolicy(ctx, ac); err != nil {
+		acLog.Info("failed to apply appPolicy", "namespace", req.Namespace, "name", req.Name, "error", err)
+		return r.handleError(ctx, ac, err)
+	}
+
+	// 解析镜像 digest
+	if err := r.resolveImages(ctx, ac); err != nil {
+		acLog.Info("failed to resolve image digest", "namespace", req.Namespace, "name", req.Name, "error", err)
+		return r.handleError(ctx, ac, err)
 	}
 
-	// 获取所有的 Deployment
-	dmMap, err := r.listDeployment(ctx, ac)
+	// 获取所有的 Deployment 和 StatefulSet
+	wlMap, err := r.listWorkload(ctx, ac)
 	if err != nil {
-		acLog.Info("failed to list deployment", "namespace", req.Namespace, "name", req.Name, "error", err)
-		return ctrl.Result{}, ignoreError(err)
+		acLog.Info("failed to list workload", "namespace", req.Namespace, "name", req.Name, "error", err)
+		return r.handleError(ctx, ac, err)
 	}
 
 	// 更新 AppConfig 的状态
-	if err := r.updateStatus(ctx, ac, dmMap); err != nil {
+	if err := r.updateStatus(ctx, ac, wlMap); err != nil {
 		acLog.Info("failed to update status", "namespace", req.Namespace, "name", req.Name, "error", err)
-		return ctrl.Result{}, ignoreError(err)
+		return r.handleError(ctx, ac, err)
 	}
 
-	// 创建或更新 AppConfig 所属资源、
-	if err := r.updateDeploy(ctx, req, ac, dmMap); err != nil {
+	// 判断是否处于暂停状态，暂停时只更新状态
+	if ac.Spec.Paused {
+		acLog.Info("appConfig is paused, skip update", "namespace", req.Namespace, "name", req.Name)
+		if err := r.setReadyCondition(ctx, ac, metav1.ConditionFalse, appv1.PausedReason, "appConfig is paused"); err != nil {
+			return r.handleError(ctx, ac, err)
+		}
+		return ctrl.Result{RequeueAfter: watchRequeue}, nil
+	}
+
+	// 创建或更新 AppConfig 所属资源
+	progressing, err := r.updateDeploy(ctx, req, ac, wlMap)
+	if err != nil {
 		acLog.Info("failed to update deploy", "namespace", req.Namespace, "name", req.Name, "error", err)
-		return ctrl.Result{}, ignoreError(err)
+		return r.handleError(ctx, ac, err)
+	}
+
+	// 创建或更新定时任务
+	if err := r.updateCronJobs(ctx, ac); err != nil {
+		acLog.Info("failed to update cronjob", "namespace", req.Namespace, "name", req.Name, "error", err)
+		return r.handleError(ctx, ac, err)
+	}
+
+	// 冻结窗口内有挂起的镜像时，到窗口结束后重新调谐
+	if hasPendingImage(ac) {
+		frozenUntil := ac.Status.FrozenUntil.Time
+		acLog.Info("appConfig is frozen, hold image update", "namespace", req.Namespace, "name", req.Name, "until", frozenUntil)
+		if err := r.setReadyCondition(ctx, ac, metav1.ConditionFalse, appv1.FrozenReason, "image update is held "+appv1.FormatFrozenUntil(frozenUntil)); err != nil {
+			return r.handleError(ctx, ac, err)
+		}
+		requeueAfter := minRequeue(frozenRequeueAfter(frozenUntil), watchRequeue)
+		if progressing {
+			requeueAfter = minRequeue(requeueAfter, rolloutRequeueAfter)
+		}
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
+
+	// 发布还未完成时定时重新调谐，不依赖其他事件触发
+	if progressing {
+		acLog.V(1).Info("rollout in progress, requeue", "namespace", req.Namespace, "name", req.Name)
+		if err := r.setReadyCondition(ctx, ac, metav1.ConditionFalse, appv1.ProgressingReason, "waiting for rollout to complete"); err != nil {
+			return r.handleError(ctx, ac, err)
+		}
+		return ctrl.Result{RequeueAfter: minRequeue(rolloutRequeueAfter, watchRequeue)}, nil
+	}
+	if err := r.setReadyCondition(ctx, ac, metav1.ConditionTrue, appv1.ReconciledReason, "all resources are up to date"); err != nil {
+		return r.handleError(ctx, ac, err)
+	}
+	return ctrl.Result{RequeueAfter: watchRequeue}, nil
+}
+
+// handleError 对错误分类：永久错误记录到状态和事件中不再重试，其他错误返回给工作队列按退避重试
+func (r *AppConfigReconciler) handleError(ctx context.Context, ac *appv1.AppConfig, err error) (ctrl.Result, error) {
+	if apierrors.IsNotFound(err) {
+		return ctrl.Result{}, nil
+	}
+	reason, ok := permanentReason(err)
+	if !ok {
+		return ctrl.Result{}, err
+	}
+	acLog.Info("permanent error, skip requeue", "namespace", ac.Namespace, "name", ac.Name, "reason", reason, "error", err)
+	r.Recorder.Event(ac, corev1.EventTypeWarning, reason, err.Error())
+	if err := r.setReadyCondition(ctx, ac, metav1.ConditionFalse, reason, err.Error()); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 	return ctrl.Result{}, nil
 }
@@ -118,6 +220,45 @@ func (r *AppConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	}); err != nil {
 		return err
 	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &appsv1.StatefulSet{}, ownerKey, func(rawObj client.Object) []string {
+		sts := rawObj.(*appsv1.StatefulSet)
+		owner := metav1.GetControllerOf(sts)
+		if owner == nil {
+			return nil
+		}
+		if owner.APIVersion != apiGVStr || owner.Kind != apiKind {
+			return nil
+		}
+		return []string{owner.Name}
+	}); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &batchv1.CronJob{}, ownerKey, func(rawObj client.Object) []string {
+		cj := rawObj.(*batchv1.CronJob)
+		owner := metav1.GetControllerOf(cj)
+		if owner == nil {
+			return nil
+		}
+		if owner.APIVersion != apiGVStr || owner.Kind != apiKind {
+			return nil
+		}
+		return []string{owner.Name}
+	}); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &batchv1.Job{}, ownerKey, func(rawObj client.Object) []string {
+		job := rawObj.(*batchv1.Job)
+		owner := metav1.GetControllerOf(job)
+		if owner == nil {
+			return nil
+		}
+		if owner.APIVersion != apiGVStr || owner.Kind != apiKind {
+			return nil
+		}
+		return []string{owner.Name}
+	}); err != nil {
+		return err
+	}
 	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Service{}, ownerKey, func(rawObj client.Object) []string {
 		svc := rawObj.(*corev1.Service)
 		owner := metav1.GetControllerOf(svc)
@@ -144,16 +285,46 @@ func (r *AppConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	}); err != nil {
 		return err
 	}
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.ConfigMap{}, ownerKey, func(rawObj client.Object) []string {
-		r.setTemplate(rawObj.(*corev1.ConfigMap))
-		return nil
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &appv1.AppConfig{}, configRefKey, func(rawObj client.Object) []string {
+		ac := rawObj.(*appv1.AppConfig)
+		var refs []string
+		for i := range ac.Spec.DeployConfigs {
+			dc := &ac.Spec.DeployConfigs[i]
+			refs = append(refs, getConfigRefs(ac.GetEnv(dc), ac.GetEnvFrom(dc))...)
+			// imagePullSecrets 变化后重新访问镜像仓库
+			pullSecrets, _ := r.getImagePullSecrets(ac, dc)
+			for _, ps := range pullSecrets {
+				refs = append(refs, secretRef+"/"+ps.Name)
+			}
+		}
+		return refs
 	}); err != nil {
 		return err
 	}
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&appv1.AppConfig{}).
 		Owns(&appsv1.Deployment{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&batchv1.CronJob{}).
+		Owns(&batchv1.Job{}).
 		Owns(&corev1.Service{}).
 		Owns(&networkingv1.Ingress{}).
-		Complete(r)
+		Watches(&appv1.AppPolicy{}, handler.EnqueueRequestsFromMapFunc(r.findAppConfigsForPolicy)).
+		// ConfigMap/Secret 只缓存 metadata，内容变化时 resourceVersion 同样变化
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.findAppConfigsForConfig(configMapRef)), builder.OnlyMetadata).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.findAppConfigsForConfig(secretRef)), builder.OnlyMetadata)
+	// Gateway API 不是必需的依赖，安装了 HTTPRoute CRD 时才监听，HTTPRoute 被修改后恢复
+	if _, err := mgr.GetRESTMapper().RESTMapping(httpRouteGVK.GroupKind(), httpRouteGVK.Version); err == nil {
+		b = b.Owns(newHTTPRoute())
+	} else if meta.IsNoMatchError(err) {
+		acLog.Info("httproute CRD is not installed, skip watching httproute")
+	} else {
+		return err
+	}
+	return b.Complete(r)
+}
+
+// UncachedObjects 只监听 metadata 的类型，client 读取时直接访问 API server，不缓存内容
+func UncachedObjects() []client.Object {
+	return []client.Object{&corev1.ConfigMap{}, &corev1.Secret{}}
 }
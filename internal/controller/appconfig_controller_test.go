@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sanmuyan.com/app-operator/internal/registry"
+)
+
+var _ = Describe("AppConfig controller", func() {
+	It("rolls out a new config hash when a referenced ConfigMap changes", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:  scheme.Scheme,
+			Metrics: metricsserver.Options{BindAddress: "0"},
+			Client:  client.Options{Cache: &client.CacheOptions{DisableFor: UncachedObjects()}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect((&AppConfigReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("appconfig-controller"),
+			Registry: registry.NewClient(nil),
+		}).SetupWithManager(mgr)).To(Succeed())
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(ctx)).To(Succeed())
+		}()
+
+		// 没有任何标签的 ConfigMap
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "demo-env", Namespace: "default"},
+			Data:       map[string]string{"MODE": "dev"},
+		}
+		Expect(k8sClient.Create(ctx, cm)).To(Succeed())
+		ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+		ac.Spec.DeployConfigs = []appv1.DeployConfig{{Name: "demo-stable", Type: appv1.StableDeploy, Image: "app:v1"}}
+		ac.Spec.EnvFrom = []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: cm.Name}}}}
+		Expect(k8sClient.Create(ctx, ac)).To(Succeed())
+
+		getHash := func() string {
+			dm := &appsv1.Deployment{}
+			if err := k8sClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "demo-stable"}, dm); err != nil {
+				return ""
+			}
+			return appv1.GetAnnotation(&dm.Spec.Template, appv1.ConfigHashAnnotation)
+		}
+		Eventually(getHash, 30*time.Second, 200*time.Millisecond).ShouldNot(BeEmpty())
+		oldHash := getHash()
+
+		cm.Data["MODE"] = "prod"
+		Expect(k8sClient.Update(ctx, cm)).To(Succeed())
+		Eventually(getHash, 30*time.Second, 200*time.Millisecond).ShouldNot(Equal(oldHash))
+	})
+})
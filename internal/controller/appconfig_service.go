@@ -6,14 +6,22 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/json"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/util/retry"
 	appv1 "sanmuyan.com/app-operator/api/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func (r *AppConfigReconciler) updateFinalizer(ctx context.Context, ac *appv1.AppConfig) error {
@@ -31,96 +39,414 @@ func (r *AppConfigReconciler) updateFinalizer(ctx context.Context, ac *appv1.App
 	return nil
 }
 
-func (r *AppConfigReconciler) listDeployment(ctx context.Context, ac *appv1.AppConfig) (map[string]*appsv1.Deployment, error) {
-	dmMap := make(map[string]*appsv1.Deployment)
-	dmList := &appsv1.DeploymentList{}
-	if err := r.List(ctx, dmList, client.InNamespace(ac.Namespace), client.MatchingFields{ownerKey: ac.Name}); err != nil {
-		return dmMap, err
+// applyPolicy 把 AppPolicy 的注解合并到 AppConfig 并检查约束
+func (r *AppConfigReconciler) applyPolicy(ctx context.Context, ac *appv1.AppConfig) error {
+	policies, err := appv1.ListAppPolicies(ctx, r.Client, ac.Namespace)
+	if err != nil {
+		return err
 	}
-	for _, dm := range dmList.Items {
-		dmMap[dm.Name] = &dm
+	appv1.ApplyAppPolicies(ac, policies)
+	if errList := appv1.ValidateAppPolicies(ac, policies); len(errList) > 0 {
+		return newPermanentError(appv1.PolicyViolationReason, errList.ToAggregate())
 	}
-	return dmMap, nil
+	return nil
+}
 
+// findAppConfigsForPolicy AppPolicy 变化时重新调谐命名空间下所有的 AppConfig
+func (r *AppConfigReconciler) findAppConfigsForPolicy(ctx context.Context, policy client.Object) []reconcile.Request {
+	acList := &appv1.AppConfigList{}
+	if err := r.List(ctx, acList, client.InNamespace(policy.GetNamespace())); err != nil {
+		acLog.Info("failed to list appConfig", "namespace", policy.GetNamespace(), "error", err)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(acList.Items))
+	for _, ac := range acList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&ac)})
+	}
+	return requests
 }
 
-func (r *AppConfigReconciler) updateStatus(ctx context.Context, ac *appv1.AppConfig, dmMap map[string]*appsv1.Deployment) error {
-	ac.Status = appv1.AppConfigStatus{
-		AvailableReplicas: 0,
-		DeployStatus:      []appv1.DeployStatus{},
+// watchImages 拉取仓库的 tag 列表，发现新的 tag 时更新 canary 的镜像，返回距离下一次拉取的间隔
+func (r *AppConfigReconciler) watchImages(ctx context.Context, ac *appv1.AppConfig) (time.Duration, error) {
+	if r.Registry == nil || ac.Spec.Paused {
+		return 0, nil
 	}
-	for _, dc := range ac.Spec.DeployConfigs {
-		status := appv1.DeployStatus{}
-		status.Type = dc.Type
-		dm, ok := dmMap[dc.Name]
+	now := time.Now()
+	// 冻结窗口内不拉取，窗口结束后重新调谐
+	if frozenUntil, frozen := appv1.FrozenUntil(ac.Spec.FreezeWindows, now); frozen {
+		return frozenRequeueAfter(frozenUntil), nil
+	}
+	var next time.Duration
+	var watchStatus []appv1.ImageWatchStatus
+	var policies []appv1.AppPolicy
+	listedPolicies := false
+	newImages := make(map[int]string)
+	for i, dc := range ac.Spec.DeployConfigs {
+		if dc.ImageWatch == nil || dc.Type != appv1.CanaryDeploy {
+			continue
+		}
+		interval := dc.ImageWatch.GetInterval()
+		ws, _ := getImageWatchStatus(dc.Name, ac.Status.ImageWatch)
+		ws.Name = dc.Name
+		if ws.LastPollTime != nil {
+			if wait := ws.LastPollTime.Add(interval).Sub(now); wait > 0 {
+				watchStatus = append(watchStatus, ws)
+				next = minRequeue(next, wait)
+				continue
+			}
+		}
+
+		ref := appv1.ParseImage(dc.Image)
+		cred, err := r.getRegistryCredential(ctx, ac, &dc, ref)
+		if err != nil {
+			return 0, err
+		}
+		tags, err := r.Registry.ListTags(ctx, ref, cred)
+		if err != nil {
+			return 0, registryError(err)
+		}
+		if !listedPolicies {
+			if policies, err = appv1.ListAppPolicies(ctx, r.Client, ac.Namespace); err != nil {
+				return 0, err
+			}
+			listedPolicies = true
+		}
+		latest, err := dc.ImageWatch.LatestTag(filterPolicyTags(dc.Image, tags, policies))
+		if err != nil {
+			return 0, newPermanentError(appv1.InvalidConfigReason, err)
+		}
+		pollTime := metav1.NewTime(now).Rfc3339Copy()
+		ws.LastPollTime = &pollTime
+		if latest != appv1.NilValue {
+			ws.LastSeenTag = latest
+			if dc.ImageWatch.ShouldUpdate(ref.Tag, latest) {
+				newImages[i] = appv1.ReplaceTag(dc.Image, latest)
+			}
+		}
+		watchStatus = append(watchStatus, ws)
+		next = minRequeue(next, interval)
+	}
+
+	if len(newImages) > 0 {
+		patch := client.MergeFromWithOptions(ac.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		for i, image := range newImages {
+			acLog.Info("new image found, update deployConfig", "namespace", ac.Namespace, "name", ac.Spec.DeployConfigs[i].Name, "image", image)
+			r.Recorder.Eventf(ac, corev1.EventTypeNormal, "ImageUpdated", "update %s image from %s to %s", ac.Spec.DeployConfigs[i].Name, ac.Spec.DeployConfigs[i].Image, image)
+			ac.Spec.DeployConfigs[i].Image = image
+		}
+		if err := r.Patch(ctx, ac, patch); err != nil {
+			return 0, err
+		}
+	}
+
+	status := ac.Status.DeepCopy()
+	status.ImageWatch = watchStatus
+	return next, r.patchStatus(ctx, ac, *status)
+}
+
+// filterPolicyTags 去掉替换后的镜像不满足 AppPolicy 镜像约束的 tag
+func filterPolicyTags(image string, tags []string, policies []appv1.AppPolicy) []string {
+	var allowed []string
+	for _, tag := range tags {
+		ok := true
+		for _, p := range policies {
+			if p.Spec.ImagePolicy != nil && p.Spec.ImagePolicy.Validate(appv1.ReplaceTag(image, tag)) != nil {
+				ok = false
+				break
+			}
+		}
 		if ok {
-			status.AvailableReplicas = dm.Status.AvailableReplicas
-			ac.Status.AvailableReplicas += dm.Status.AvailableReplicas
-			statusAvailable, ok := getCondition(appsv1.DeploymentAvailable, dm.Status.Conditions)
-			if ok {
-				status.AvailableStatus = statusAvailable.Status
+			allowed = append(allowed, tag)
+		}
+	}
+	return allowed
+}
+
+// resolveImages 把 deployConfig 的镜像 tag 解析为 digest，只在内存中替换
+// 同一个 tag 只解析一次并记录到状态中，保证 canary 和 stable 使用相同的镜像内容
+func (r *AppConfigReconciler) resolveImages(ctx context.Context, ac *appv1.AppConfig) error {
+	if appv1.GetAnnotation(ac, appv1.ResolveDigestAnnotation) != appv1.TureValue || r.Registry == nil {
+		if ac.Status.ImageDigests == nil {
+			return nil
+		}
+		status := ac.Status.DeepCopy()
+		status.ImageDigests = nil
+		return r.patchStatus(ctx, ac, *status)
+	}
+	var digests map[string]string
+	for i, dc := range ac.Spec.DeployConfigs {
+		ref := appv1.ParseImage(dc.Image)
+		if ref.Digest != appv1.NilValue {
+			continue
+		}
+		digest, ok := ac.Status.ImageDigests[dc.Image]
+		if !ok {
+			cred, err := r.getRegistryCredential(ctx, ac, &dc, ref)
+			if err != nil {
+				return err
+			}
+			digest, err = r.Registry.ResolveDigest(ctx, ref, cred)
+			if err != nil {
+				return registryError(err)
 			}
+			acLog.Info("image digest resolved", "namespace", ac.Namespace, "name", dc.Name, "image", dc.Image, "digest", digest)
+		}
+		if digests == nil {
+			digests = make(map[string]string)
+		}
+		digests[dc.Image] = digest
+		ac.Spec.DeployConfigs[i].Image = dc.Image + "@" + digest
+	}
+	status := ac.Status.DeepCopy()
+	status.ImageDigests = digests
+	return r.patchStatus(ctx, ac, *status)
+}
+
+// listWorkload 获取所有的 Deployment 和 StatefulSet
+// 切换工作负载类型期间同名的两种工作负载同时存在，优先返回 deployConfig 当前的类型
+func (r *AppConfigReconciler) listWorkload(ctx context.Context, ac *appv1.AppConfig) (map[string]client.Object, error) {
+	wlMap := make(map[string]client.Object)
+	kinds := make(map[string]appv1.WorkloadKind)
+	for i := range ac.Spec.DeployConfigs {
+		kinds[ac.Spec.DeployConfigs[i].Name] = ac.Spec.DeployConfigs[i].GetWorkloadKind()
+	}
+	add := func(wl client.Object) {
+		if old, ok := wlMap[wl.GetName()]; ok && getWorkloadKind(old) == kinds[wl.GetName()] {
+			return
+		}
+		wlMap[wl.GetName()] = wl
+	}
+	dmList := &appsv1.DeploymentList{}
+	if err := r.List(ctx, dmList, client.InNamespace(ac.Namespace), client.MatchingFields{ownerKey: ac.Name}); err != nil {
+		return wlMap, err
+	}
+	for i := range dmList.Items {
+		add(&dmList.Items[i])
+	}
+	stsList := &appsv1.StatefulSetList{}
+	if err := r.List(ctx, stsList, client.InNamespace(ac.Namespace), client.MatchingFields{ownerKey: ac.Name}); err != nil {
+		return wlMap, err
+	}
+	for i := range stsList.Items {
+		add(&stsList.Items[i])
+	}
+	return wlMap, nil
+}
 
-			statusProgressing, ok := getCondition(appsv1.DeploymentProgressing, dm.Status.Conditions)
-			if ok {
-				status.ProgressingStatus = statusProgressing.Status
+func (r *AppConfigReconciler) updateStatus(ctx context.Context, ac *appv1.AppConfig, wlMap map[string]client.Object) error {
+	status := ac.Status.DeepCopy()
+	status.AvailableReplicas = 0
+	status.DeployStatus = []appv1.DeployStatus{}
+	status.FrozenUntil = nil
+	frozenUntil, frozen := appv1.FrozenUntil(ac.Spec.FreezeWindows, time.Now())
+	if frozen {
+		until := metav1.NewTime(frozenUntil).Rfc3339Copy()
+		status.FrozenUntil = &until
+	}
+	for _, dc := range ac.Spec.DeployConfigs {
+		ds := appv1.DeployStatus{}
+		ds.Type = dc.Type
+		ds.WorkloadKind = dc.GetWorkloadKind()
+		ds.DesiredReplicas = ac.GetDesiredReplicas(&dc)
+		if dc.Type == appv1.CanaryDeploy && isCanaryIdle(ac, wlMap) {
+			ds.Idle = true
+			ds.DesiredReplicas = 0
+		}
+		wl, ok := wlMap[dc.Name]
+		if ok && getWorkloadKind(wl) == ds.WorkloadKind {
+			if appContainer, ok := getContainer(appName, getPodTemplate(wl).Spec.Containers); ok {
+				ds.Image = appContainer.Image
 			}
+			ws := getWorkloadStatus(wl)
+			ds.AvailableReplicas = ws.AvailableReplicas
+			status.AvailableReplicas += ws.AvailableReplicas
+			ds.AvailableStatus = ws.Available
+			ds.ProgressingStatus = ws.Progressing
 		} else {
-			status.AvailableReplicas = 0
-			status.ProgressingStatus = corev1.ConditionUnknown
-			status.AvailableStatus = corev1.ConditionUnknown
+			ds.AvailableReplicas = 0
+			ds.ProgressingStatus = corev1.ConditionUnknown
+			ds.AvailableStatus = corev1.ConditionUnknown
+		}
+		if frozen && ds.Image != appv1.NilValue && ds.Image != dc.Image {
+			ds.PendingImage = dc.Image
+		}
+		status.DeployStatus = append(status.DeployStatus, ds)
+	}
+
+	return r.patchStatus(ctx, ac, *status)
+}
+
+// setReadyCondition 设置 Ready 状态条件
+func (r *AppConfigReconciler) setReadyCondition(ctx context.Context, ac *appv1.AppConfig, s metav1.ConditionStatus, reason, message string) error {
+	status := ac.Status.DeepCopy()
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               appv1.ReadyCondition,
+		Status:             s,
+		ObservedGeneration: ac.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	return r.patchStatus(ctx, ac, *status)
+}
+
+// patchStatus 只在状态变化时 patch，冲突时重新获取最新对象后重试
+func (r *AppConfigReconciler) patchStatus(ctx context.Context, ac *appv1.AppConfig, status appv1.AppConfigStatus) error {
+	if equality.Semantic.DeepEqual(ac.Status, status) {
+		return nil
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &appv1.AppConfig{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(ac), latest); err != nil {
+			return err
 		}
-		ac.Status.DeployStatus = append(ac.Status.DeployStatus, status)
+		if equality.Semantic.DeepEqual(latest.Status, status) {
+			return nil
+		}
+		patch := client.MergeFromWithOptions(latest.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		latest.Status = status
+		return r.Status().Patch(ctx, latest, patch)
+	})
+	if err != nil {
+		return err
 	}
-	return r.Status().Update(ctx, ac)
+	ac.Status = status
+	return nil
 }
 
-func (r *AppConfigReconciler) setTemplate(cm *corev1.ConfigMap) {
-	if getNamePath(&cm.ObjectMeta) == templatePath {
+// loadTemplate 读取 TEMPLATE_PATH（<namespace>/<name>）指定的全局模板，ConfigMap 不在缓存中，每次调谐时重新读取
+func (r *AppConfigReconciler) loadTemplate(ctx context.Context) error {
+	namespace, name, ok := strings.Cut(templatePath, "/")
+	if !ok {
+		return nil
+	}
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, cm); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if old := templateCM.Swap(cm); old == nil || old.ResourceVersion != cm.ResourceVersion {
 		acLog.Info("set template config", "namespace", cm.Namespace, "name", cm.Name)
-		templateCM = cm
 	}
+	return nil
+}
+
+// getTemplate 返回全局模板中 key 对应的内容
+func getTemplate(key string) (string, bool) {
+	cm := templateCM.Load()
+	if cm == nil {
+		return "", false
+	}
+	tmpl, ok := cm.Data[key]
+	return tmpl, ok
 }
 
-func (r *AppConfigReconciler) updateDeploy(ctx context.Context, req ctrl.Request, ac *appv1.AppConfig, dmMap map[string]*appsv1.Deployment) error {
-	for _, dc := range ac.Spec.DeployConfigs {
+// updateDeploy 创建或更新所属资源，返回值表示是否还有发布未完成
+func (r *AppConfigReconciler) updateDeploy(ctx context.Context, req ctrl.Request, ac *appv1.AppConfig, wlMap map[string]client.Object) (bool, error) {
+	progressing := false
+	if err := r.cleanupHookJobs(ctx, ac); err != nil {
+		return progressing, err
+	}
+	// canary 总是先于 stable 更新，保证严格发布模式下 stable 看到的是本轮 canary 的状态
+	for _, dc := range sortDeployConfigs(ac.Spec.DeployConfigs) {
 		acLog.V(1).Info("updating deployConfig", "namespace", req.Namespace, "name", dc.Name)
-		req.MarshalLog()
+		// canary 按 stable 的百分比计算副本数，stable 扩缩容时跟随变化
+		replicas := ac.GetDesiredReplicas(&dc)
+		// canary 空闲时缩容到 0，镜像变化后恢复
+		idle := dc.Type == appv1.CanaryDeploy && isCanaryIdle(ac, wlMap)
+		if idle {
+			acLog.V(1).Info("canary idle, scale to zero", "namespace", req.Namespace, "name", dc.Name)
+			replicas = 0
+		}
+		dc.Replicas = &replicas
 		if appv1.GetAnnotation(ac, appv1.StrictReleaseAnnotation) == appv1.TureValue {
-			// 开启严格发布模式后，canary 部署失败时，stable 不允许更新
-			if dc.Type == appv1.StableDeploy {
-				canaryStatus, ok := getDeployStatus(appv1.CanaryDeploy, ac.Status.DeployStatus)
-				if !ok || canaryStatus.ProgressingStatus != corev1.ConditionTrue || canaryStatus.AvailableStatus != corev1.ConditionTrue {
-					acLog.V(1).Info("canary deploy failed, skip update", "namespace", req.Namespace, "name", req.Name)
-					continue
-				}
+			// 开启严格发布模式后，当前版本的 canary 没有可用时，stable 不允许更新
+			// 执行过 skip-analysis 的 canary 镜像不再等待可用
+			if dc.Type == appv1.StableDeploy && !isCanaryReleased(ac, wlMap) && !isSkipAnalysis(ac) {
+				acLog.V(1).Info("canary revision not available, skip update", "namespace", req.Namespace, "name", dc.Name)
+				r.blockedBy(strictReleaseGate, dc.Name, "canary revision is not available")
+				progressing = true
+				continue
 			}
-
 		}
 
-		dm, ok := dmMap[dc.Name]
+		kind := dc.GetWorkloadKind()
+		wl, ok := wlMap[dc.Name]
+		if ok && getWorkloadKind(wl) != kind {
+			// 工作负载类型变化时先创建新的工作负载，发布完成后再删除旧的
+			acLog.Info("workload kind changed, create new workload", "namespace", req.Namespace, "name", dc.Name, "kind", kind)
+			ok = false
+		}
 		if ok {
+			appContainer, hasApp := getContainer(appName, getPodTemplate(wl).Spec.Containers)
+			if ac.Status.FrozenUntil != nil {
+				// 冻结窗口内保持当前镜像，其他配置照常更新
+				if hasApp && appContainer.Image != dc.Image {
+					acLog.V(1).Info("deploy frozen, hold image", "namespace", req.Namespace, "name", dc.Name, "image", appContainer.Image)
+					r.blockedBy(freezeWindowGate, dc.Name, "image "+dc.Image+" is held "+appv1.FormatFrozenUntil(ac.Status.FrozenUntil.Time))
+					dc.Image = appContainer.Image
+				}
+			}
 			if appv1.GetAnnotation(ac, appv1.StrictUpdateAnnotation) == appv1.TureValue {
 				// 开启严格更新模式后 image replicas 都没有变化的情况下暂停更新
-				appContainer, ok := getContainer(appName, dm.Spec.Template.Spec.Containers)
-				if ok {
-					if appContainer.Image == dc.Image && *dm.Spec.Replicas == *dc.Replicas {
-						acLog.V(1).Info("image replicas no changes, skip update", "namespace", req.Namespace, "name", req.Name)
-						continue
+				if hasApp && appContainer.Image == dc.Image && getReplicas(wl) == replicas {
+					acLog.V(1).Info("image replicas no changes, skip update", "namespace", req.Namespace, "name", req.Name)
+					r.blockedBy(strictUpdateGate, dc.Name, "image and replicas are not changed")
+					if !isRolloutComplete(wl) {
+						progressing = true
 					}
+					continue
 				}
 			}
 		} else {
-			dm = &appsv1.Deployment{}
+			wl = newWorkload(kind)
 		}
-		dm.SetNamespace(ac.Namespace)
-		dm.SetName(dc.Name)
 
-		res, err := controllerutil.CreateOrUpdate(ctx, r.Client, dm, r.setDeployment(dm, ac, &dc))
+		// stable 镜像变化时先执行 pre hook，全部成功后才更新
+		if dc.Type == appv1.StableDeploy {
+			appContainer, hasApp := getContainer(appName, getPodTemplate(wl).Spec.Containers)
+			if !hasApp || appContainer.Image != dc.Image {
+				done, err := r.runHooks(ctx, ac, appv1.PreHook, dc.Image)
+				if err != nil {
+					return progressing, err
+				}
+				if !done {
+					acLog.V(1).Info("waiting for pre hooks, skip update", "namespace", req.Namespace, "name", dc.Name)
+					r.blockedBy(preHookGate, dc.Name, "waiting for pre hooks of image "+dc.Image)
+					progressing = true
+					continue
+				}
+			}
+		}
+		pc, err := r.getPodConfig(ctx, ac, &dc)
 		if err != nil {
-			return err
+			return progressing, err
+		}
+		wl.SetNamespace(ac.Namespace)
+		wl.SetName(dc.Name)
+
+		res, err := controllerutil.CreateOrUpdate(ctx, r.Client, wl, r.setWorkload(wl, ac, &dc, pc))
+		if err != nil {
+			return progressing, err
+		}
+		wlMap[dc.Name] = wl
+		acLog.V(1).Info("workload updated", "namespace", req.Namespace, "name", dc.Name, "kind", kind, "result", res)
+		if !isRolloutComplete(wl) {
+			progressing = true
+		} else if err := r.cleanupOldWorkload(ctx, ac, &dc); err != nil {
+			return progressing, err
+		}
+
+		if kind == appv1.StatefulSetWorkload {
+			// StatefulSet 需要 headless service 提供稳定的网络标识
+			svc := &corev1.Service{}
+			svc.SetNamespace(ac.Namespace)
+			svc.SetName(getHeadlessSvcName(dc.Name))
+			res, err := controllerutil.CreateOrUpdate(ctx, r.Client, svc, r.setHeadlessSvc(svc, ac, &dc))
+			if err != nil {
+				return progressing, err
+			}
+			acLog.V(1).Info("headless service updated", "namespace", ac.Namespace, "name", svc.Name, "result", res)
 		}
-		acLog.V(1).Info("deployment updated", "namespace", req.Namespace, "name", dc.Name, "result", res)
 
 		if ac.Spec.Service.Enable {
 			svc := &corev1.Service{}
@@ -128,40 +454,137 @@ func (r *AppConfigReconciler) updateDeploy(ctx context.Context, req ctrl.Request
 			svc.SetName(dc.Name)
 			res, err := controllerutil.CreateOrUpdate(ctx, r.Client, svc, r.setSvc(svc, ac, &dc))
 			if err != nil {
-				return err
+				return progressing, err
 			}
 			acLog.V(1).Info("service updated", "namespace", ac.Namespace, "name", dc.Name, "result", res)
 		}
 
-		if ac.Spec.Ingress.Enable {
+		if ac.Spec.Ingress.Enable && !idle {
 			ingress := &networkingv1.Ingress{}
 			ingress.SetNamespace(ac.Namespace)
 			ingress.SetName(dc.Name)
-			res, err := controllerutil.CreateOrUpdate(ctx, r.Client, ingress, r.setIngress(ingress, ac, &dc))
+			weightPending := false
+			res, err := controllerutil.CreateOrUpdate(ctx, r.Client, ingress, r.setIngress(ingress, ac, &dc, &weightPending))
 			if err != nil {
-				return err
+				return progressing, err
+			}
+			// 权重还没有到达目标时按间隔重新调谐
+			if weightPending {
+				progressing = true
 			}
 			acLog.V(1).Info("ingress updated", "namespace", ac.Namespace, "name", ac.Name, "result", res)
+		} else if idle {
+			// 空闲的 canary 不需要 ingress
+			ingress := &networkingv1.Ingress{}
+			if err := r.Get(ctx, client.ObjectKey{Namespace: ac.Namespace, Name: dc.Name}, ingress); err == nil {
+				acLog.Info("canary idle, delete ingress", "namespace", ac.Namespace, "name", dc.Name)
+				if err := r.Delete(ctx, ingress); client.IgnoreNotFound(err) != nil {
+					return progressing, err
+				}
+			} else if !apierrors.IsNotFound(err) {
+				return progressing, err
+			}
 		}
 	}
-	return nil
+
+	if err := r.cleanupConfigFiles(ctx, ac, wlMap); err != nil {
+		return progressing, err
+	}
+	if err := r.updateMirror(ctx, ac); err != nil {
+		return progressing, err
+	}
+
+	// stable 以当前镜像发布完成后执行 post hook
+	if stable, ok := ac.GetDeployConfig(appv1.StableDeploy); ok {
+		if wl, ok := wlMap[stable.Name]; ok {
+			appContainer, hasApp := getContainer(appName, getPodTemplate(wl).Spec.Containers)
+			if hasApp && appContainer.Image == stable.Image && isRolloutComplete(wl) {
+				done, err := r.runHooks(ctx, ac, appv1.PostHook, stable.Image)
+				if err != nil {
+					return progressing, err
+				}
+				if !done {
+					progressing = true
+				}
+			}
+		}
+	}
+	return progressing, nil
+}
+
+// cleanupOldWorkload 新的工作负载发布完成后删除类型变化前的工作负载，StatefulSet 同时删除 headless service
+func (r *AppConfigReconciler) cleanupOldWorkload(ctx context.Context, ac *appv1.AppConfig, dc *appv1.DeployConfig) error {
+	oldKind := appv1.StatefulSetWorkload
+	if dc.GetWorkloadKind() == appv1.StatefulSetWorkload {
+		oldKind = appv1.DeploymentWorkload
+	}
+	old := newWorkload(oldKind)
+	if err := r.Get(ctx, client.ObjectKey{Namespace: ac.Namespace, Name: dc.Name}, old); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if owner := metav1.GetControllerOf(old); owner == nil || owner.UID != ac.UID {
+		return nil
+	}
+	acLog.Info("workload kind changed, delete old workload", "namespace", ac.Namespace, "name", dc.Name, "kind", oldKind)
+	if err := r.Delete(ctx, old); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	if oldKind != appv1.StatefulSetWorkload {
+		return nil
+	}
+	svc := &corev1.Service{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: ac.Namespace, Name: getHeadlessSvcName(dc.Name)}, svc); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if owner := metav1.GetControllerOf(svc); owner == nil || owner.UID != ac.UID {
+		return nil
+	}
+	acLog.Info("delete headless service", "namespace", ac.Namespace, "name", svc.Name)
+	return client.IgnoreNotFound(r.Delete(ctx, svc))
 }
 
-func (r *AppConfigReconciler) setIngress(ingress *networkingv1.Ingress, ac *appv1.AppConfig, dc *appv1.DeployConfig) controllerutil.MutateFn {
+// setIngress weightPending 返回 canary 滚动权重是否还没有到达目标
+func (r *AppConfigReconciler) setIngress(ingress *networkingv1.Ingress, ac *appv1.AppConfig, dc *appv1.DeployConfig, weightPending *bool) controllerutil.MutateFn {
 	return func() error {
+		// 重置注解前记录当前权重和上一次变化的时间，用于平滑切换
+		currentWeight, err := strconv.Atoi(ingress.Annotations[appv1.NginxIngressWeightAnnotation])
+		if err != nil {
+			currentWeight = 0
+		}
+		lastStep, err := time.Parse(time.RFC3339, appv1.GetAnnotation(ingress, appv1.CanaryWeightUpdatedAnnotation))
+		if err != nil {
+			lastStep = time.Time{}
+		}
 		ingress.Annotations = make(map[string]string)
 		if dc.Type == appv1.CanaryDeploy {
 			if appv1.GetAnnotation(ac, appv1.CanaryIngressAnnotation) == appv1.TureValue {
 				appv1.AddAnnotation(ingress, appv1.CanaryIngressAnnotation, appv1.TureValue)
+				if appv1.GetAnnotation(ac, appv1.CanaryRollingWeightAnnotation) == appv1.TureValue {
+					weight, target, err := getCanaryRollingWeight(ac, currentWeight, lastStep)
+					if err != nil {
+						return err
+					}
+					if weight != currentWeight {
+						lastStep = time.Now()
+					}
+					if !lastStep.IsZero() {
+						appv1.AddAnnotation(ingress, appv1.CanaryWeightUpdatedAnnotation, lastStep.UTC().Format(time.RFC3339))
+					}
+					*weightPending = weight != target
+					appv1.AddOtherAnnotation(ingress, appv1.NginxIngressCanaryAnnotation, appv1.TureValue)
+					appv1.AddOtherAnnotation(ingress, appv1.NginxIngressWeightAnnotation, strconv.Itoa(weight))
+				}
 			} else {
 				appv1.AddOtherAnnotation(ingress, appv1.NginxIngressCanaryAnnotation, appv1.FalseValue)
 				appv1.AddOtherAnnotation(ingress, appv1.NginxIngressWeightAnnotation, "0")
 			}
-			if appv1.GetAnnotation(ingress, appv1.CanaryRollingWeightAnnotation) == appv1.TureValue {
-				canaryStatus, ok := getDeployStatus(appv1.CanaryDeploy, ac.Status.DeployStatus)
-				if ok {
-					weight := float32(canaryStatus.AvailableReplicas) / float32(ac.Status.AvailableReplicas) * 100
-					appv1.AddOtherAnnotation(ingress, appv1.NginxIngressWeightAnnotation, fmt.Sprint(int32(weight)))
+		}
+		if dc.Type == appv1.StableDeploy && isMirrorActive(ac) && ac.Spec.Mirror.GetProvider() == appv1.NginxMirror {
+			// 复制 stable 的请求到 canary service
+			if canary, ok := ac.GetDeployConfig(appv1.CanaryDeploy); ok {
+				appv1.AddOtherAnnotation(ingress, appv1.NginxIngressMirrorAnnotation, getMirrorTarget(ac, canary.Name))
+				if ac.Spec.Ingress.Host != appv1.NilValue {
+					appv1.AddOtherAnnotation(ingress, appv1.NginxIngressMirrorHostAnnotation, ac.Spec.Ingress.Host)
 				}
 			}
 		}
@@ -169,7 +592,7 @@ func (r *AppConfigReconciler) setIngress(ingress *networkingv1.Ingress, ac *appv
 			var annotationsList []map[string]string
 			err := json.Unmarshal([]byte(annotations), &annotationsList)
 			if err != nil {
-				return err
+				return newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("invalid %s annotation: %w", appv1.IngressAnnotationsAnnotation, err))
 			}
 			for _, annotation := range annotationsList {
 				for k, v := range annotation {
@@ -227,10 +650,122 @@ func (r *AppConfigReconciler) setSvc(svc *corev1.Service, ac *appv1.AppConfig, d
 	}
 }
 
-func (r *AppConfigReconciler) setDeployment(dm *appsv1.Deployment, ac *appv1.AppConfig, dc *appv1.DeployConfig) controllerutil.MutateFn {
+// setWorkload 根据工作负载类型设置 Deployment 或 StatefulSet
+func (r *AppConfigReconciler) setWorkload(wl client.Object, ac *appv1.AppConfig, dc *appv1.DeployConfig, pc *podConfig) controllerutil.MutateFn {
+	if sts, ok := wl.(*appsv1.StatefulSet); ok {
+		return r.setStatefulSet(sts, ac, dc, pc)
+	}
+	return r.setDeployment(wl.(*appsv1.Deployment), ac, dc, pc)
+}
+
+// getPodConfig 计算引用配置的哈希，创建配置文件 ConfigMap
+func (r *AppConfigReconciler) getPodConfig(ctx context.Context, ac *appv1.AppConfig, dc *appv1.DeployConfig) (*podConfig, error) {
+	configHash, err := r.getConfigHash(ctx, ac, dc)
+	if err != nil {
+		return nil, err
+	}
+	configFiles, err := r.updateConfigFiles(ctx, ac, dc)
+	if err != nil {
+		return nil, err
+	}
+	pc := &podConfig{configHash: configHash, configFiles: configFiles}
+	if cf := ac.GetConfigFiles(dc); cf != nil {
+		pc.configMountPath = cf.MountPath
+	}
+	return pc, nil
+}
+
+// renderPodTemplate 按配置渲染 deployConfig 的 Pod 模板，不修改工作负载
+func (r *AppConfigReconciler) renderPodTemplate(ctx context.Context, ac *appv1.AppConfig, dc *appv1.DeployConfig) (*corev1.PodTemplateSpec, error) {
+	pc, err := r.getPodConfig(ctx, ac, dc)
+	if err != nil {
+		return nil, err
+	}
+	wl := newWorkload(dc.GetWorkloadKind())
+	wl.SetNamespace(ac.Namespace)
+	wl.SetName(dc.Name)
+	if err := r.setWorkload(wl, ac, dc, pc)(); err != nil {
+		return nil, err
+	}
+	return getPodTemplate(wl), nil
+}
+
+func (r *AppConfigReconciler) setHeadlessSvc(svc *corev1.Service, ac *appv1.AppConfig, dc *appv1.DeployConfig) controllerutil.MutateFn {
+	return func() error {
+		svc.Labels = make(map[string]string)
+		appv1.AddOtherLabel(svc, appv1.CreatedByLabel, appv1.OperatorName)
+		svc.Spec.ClusterIP = corev1.ClusterIPNone
+		svc.Spec.PublishNotReadyAddresses = true
+		svc.Spec.Selector = make(map[string]string)
+		svc.Spec.Selector[appName] = dc.Name
+		svc.Spec.Ports = nil
+		if ac.Spec.Service.Enable {
+			svc.Spec.Ports = []corev1.ServicePort{
+				{
+					Name:       appName,
+					Port:       ac.Spec.Service.Port,
+					TargetPort: intstr.FromInt32(ac.Spec.Service.Port),
+				},
+			}
+		}
+
+		return ctrl.SetControllerReference(ac, svc, r.Scheme)
+	}
+}
+
+// setPodMeta 设置 pod 模板的标签和注解
+func (r *AppConfigReconciler) setPodMeta(tmpl *corev1.PodTemplateSpec, ac *appv1.AppConfig, dc *appv1.DeployConfig, pc *podConfig) {
+	tmpl.Labels = make(map[string]string)
+	appv1.AddOtherLabel(tmpl, appv1.AppName, dc.Name)
+
+	appv1.AddLabel(tmpl, appv1.InjectionLabel, appv1.TureValue)
+
+	tmpl.Annotations = make(map[string]string)
+	if v := appv1.GetAnnotation(ac, appv1.ContainersInjectionAnnotation); v != appv1.NilValue {
+		appv1.AddAnnotation(tmpl, appv1.ContainersInjectionAnnotation, v)
+	}
+	if v := appv1.GetAnnotation(ac, appv1.SidecarProfileAnnotation); v != appv1.NilValue {
+		appv1.AddAnnotation(tmpl, appv1.SidecarProfileAnnotation, v)
+	}
+	if pc.configHash != appv1.NilValue {
+		appv1.AddAnnotation(tmpl, appv1.ConfigHashAnnotation, pc.configHash)
+	}
+}
+
+// setAppContainer 设置 app 容器，wl 上记录 app 容器由 AppConfig 设置的环境变量
+func (r *AppConfigReconciler) setAppContainer(wl client.Object, tmpl *corev1.PodTemplateSpec, ac *appv1.AppConfig, dc *appv1.DeployConfig) {
+	if _, ok := getContainer(appName, tmpl.Spec.Containers); !ok {
+		tmpl.Spec.Containers = append(tmpl.Spec.Containers, corev1.Container{
+			Name:  appName,
+			Image: dc.Image,
+		})
+	}
+	setContainerImage(appName, dc.Image, tmpl.Spec.Containers)
+	for i, c := range tmpl.Spec.Containers {
+		if c.Name == appName {
+			setManagedEnv(wl, setContainerEnv(&tmpl.Spec.Containers[i], ac.GetEnv(dc), ac.GetEnvFrom(dc), getManagedEnv(wl)))
+			setContainerConfig(&tmpl.Spec.Containers[i], ac.GetContainerConfig(dc))
+		}
+	}
+}
+
+// loadDeploymentConfig 加载 deployment-config 注解，StatefulSet 同样适用
+func (r *AppConfigReconciler) loadDeploymentConfig(obj client.Object, ac *appv1.AppConfig) error {
+	if v := appv1.GetAnnotation(ac, appv1.DeploymentConfigAnnotation); v != appv1.NilValue {
+		acLog.V(1).Info("loading deployment annotation", "namespace", obj.GetNamespace(), "name", obj.GetName())
+		err := json.Unmarshal([]byte(v), obj)
+		if err != nil {
+			return newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("invalid %s annotation: %w", appv1.DeploymentConfigAnnotation, err))
+		}
+	}
+	return nil
+}
+
+func (r *AppConfigReconciler) setDeployment(dm *appsv1.Deployment, ac *appv1.AppConfig, dc *appv1.DeployConfig, pc *podConfig) controllerutil.MutateFn {
 	return func() error {
+		resetContainerConfig(dm.Spec.Template.Spec.Containers)
 		// 加载全局配置
-		if dmTmpl, ok := templateCM.Data["deployment"]; ok {
+		if dmTmpl, ok := getTemplate("deployment"); ok {
 			acLog.V(1).Info("loading deployment template", "namespace", dm.Namespace, "name", dm.Name)
 			if err := yaml.Unmarshal([]byte(dmTmpl), dm); err != nil {
 				acLog.Info("failed to unmarshal deployment template", "namespace", dm.Namespace, "name", dm.Name, "error", err)
@@ -242,38 +777,21 @@ func (r *AppConfigReconciler) setDeployment(dm *appsv1.Deployment, ac *appv1.App
 		appv1.AddOtherLabel(dm, appName, dc.Name)
 		appv1.AddOtherLabel(dm, appv1.CreatedByLabel, appv1.OperatorName)
 
-		dm.Spec.Template.Labels = make(map[string]string)
-		appv1.AddOtherLabel(&dm.Spec.Template, appv1.AppName, dc.Name)
-
 		dm.Spec.Selector = &metav1.LabelSelector{
 			MatchLabels: make(map[string]string),
 		}
 		dm.Spec.Selector.MatchLabels[appName] = dc.Name
 
 		// 设置注解
-		dm.Spec.Template.Annotations = make(map[string]string)
-		if v := appv1.GetAnnotation(ac, appv1.ContainersInjectionAnnotation); v != appv1.NilValue {
-			appv1.AddAnnotation(&dm.Spec.Template, appv1.ContainersInjectionAnnotation, v)
-			appv1.AddLabel(&dm.Spec.Template, appv1.InjectionLabel, appv1.TureValue)
-		}
-
-		if v := appv1.GetAnnotation(ac, appv1.DeploymentConfigAnnotation); v != appv1.NilValue {
-			acLog.V(1).Info("loading deployment annotation", "namespace", dm.Namespace, "name", dm.Name)
-			err := json.Unmarshal([]byte(v), dm)
-			if err != nil {
-				return err
-			}
+		r.setPodMeta(&dm.Spec.Template, ac, dc, pc)
+		if err := r.loadDeploymentConfig(dm, ac); err != nil {
+			return err
 		}
 
 		// 设置容器
 		dm.Spec.Replicas = dc.Replicas
-		if _, ok := getContainer(appName, dm.Spec.Template.Spec.Containers); !ok {
-			dm.Spec.Template.Spec.Containers = append(dm.Spec.Template.Spec.Containers, corev1.Container{
-				Name:  appName,
-				Image: dc.Image,
-			})
-		}
-		setContainerImage(appName, dc.Image, dm.Spec.Template.Spec.Containers)
+		r.setAppContainer(dm, &dm.Spec.Template, ac, dc)
+		setConfigFilesVolume(&dm.Spec.Template, pc)
 
 		dm.ResourceVersion = ""
 		dm.SetName(dc.Name)
@@ -281,3 +799,74 @@ func (r *AppConfigReconciler) setDeployment(dm *appsv1.Deployment, ac *appv1.App
 		return ctrl.SetControllerReference(ac, dm, r.Scheme)
 	}
 }
+
+func (r *AppConfigReconciler) setStatefulSet(sts *appsv1.StatefulSet, ac *appv1.AppConfig, dc *appv1.DeployConfig, pc *podConfig) controllerutil.MutateFn {
+	return func() error {
+		// 配置中去掉 OnDelete 后恢复为默认的 RollingUpdate
+		if sts.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+			sts.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: new(int32)},
+			}
+		}
+		resetContainerConfig(sts.Spec.Template.Spec.Containers)
+		// 加载全局配置
+		if stsTmpl, ok := getTemplate("statefulset"); ok {
+			acLog.V(1).Info("loading statefulset template", "namespace", sts.Namespace, "name", sts.Name)
+			if err := yaml.Unmarshal([]byte(stsTmpl), sts); err != nil {
+				acLog.Info("failed to unmarshal statefulset template", "namespace", sts.Namespace, "name", sts.Name, "error", err)
+			}
+		}
+
+		// 标签设置
+		sts.Labels = make(map[string]string)
+		appv1.AddOtherLabel(sts, appName, dc.Name)
+		appv1.AddOtherLabel(sts, appv1.CreatedByLabel, appv1.OperatorName)
+
+		sts.Spec.Selector = &metav1.LabelSelector{
+			MatchLabels: make(map[string]string),
+		}
+		sts.Spec.Selector.MatchLabels[appName] = dc.Name
+		sts.Spec.ServiceName = getHeadlessSvcName(dc.Name)
+
+		// 设置注解
+		r.setPodMeta(&sts.Spec.Template, ac, dc, pc)
+		if err := r.loadDeploymentConfig(sts, ac); err != nil {
+			return err
+		}
+
+		// OnDelete 需要手动删除 Pod 才会更新，发布永远不会完成
+		if sts.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+			return newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("statefulset update strategy %s is not supported", appsv1.OnDeleteStatefulSetStrategyType))
+		}
+
+		// volumeClaimTemplates 创建后不允许修改
+		if sts.CreationTimestamp.IsZero() {
+			sts.Spec.VolumeClaimTemplates = nil
+			for _, vct := range dc.VolumeClaimTemplates {
+				sts.Spec.VolumeClaimTemplates = append(sts.Spec.VolumeClaimTemplates, corev1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Name: vct.Name},
+					Spec:       vct.Spec,
+				})
+			}
+		}
+
+		// 设置容器
+		sts.Spec.Replicas = dc.Replicas
+		r.setAppContainer(sts, &sts.Spec.Template, ac, dc)
+		setConfigFilesVolume(&sts.Spec.Template, pc)
+		for i, c := range sts.Spec.Template.Spec.Containers {
+			if c.Name != appName {
+				continue
+			}
+			for _, vct := range dc.VolumeClaimTemplates {
+				setVolumeMount(vct.Name, vct.MountPath, &sts.Spec.Template.Spec.Containers[i])
+			}
+		}
+
+		sts.ResourceVersion = ""
+		sts.SetName(dc.Name)
+		sts.SetNamespace(ac.Namespace)
+		return ctrl.SetControllerReference(ac, sts, r.Scheme)
+	}
+}
@@ -0,0 +1,381 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sort"
+	"strings"
+)
+
+// getConfigHash 计算 deployConfig 引用的 ConfigMap/Secret 内容哈希，不存在的引用会被跳过
+func (r *AppConfigReconciler) getConfigHash(ctx context.Context, ac *appv1.AppConfig, dc *appv1.DeployConfig) (string, error) {
+	refs := getConfigRefs(ac.GetEnv(dc), ac.GetEnvFrom(dc))
+	if len(refs) == 0 {
+		return "", nil
+	}
+	h := sha256.New()
+	for _, ref := range refs {
+		kind, name, _ := strings.Cut(ref, "/")
+		key := client.ObjectKey{Namespace: ac.Namespace, Name: name}
+		data := make(map[string][]byte)
+		switch kind {
+		case configMapRef:
+			cm := &corev1.ConfigMap{}
+			if err := r.Get(ctx, key, cm); err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return "", err
+			}
+			for k, v := range cm.Data {
+				data[k] = []byte(v)
+			}
+			for k, v := range cm.BinaryData {
+				data[k] = v
+			}
+		case secretRef:
+			secret := &corev1.Secret{}
+			if err := r.Get(ctx, key, secret); err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return "", err
+			}
+			data = secret.Data
+		}
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(h, "%s\n", ref)
+		for _, k := range keys {
+			fmt.Fprintf(h, "%s=%x\n", k, data[k])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// findAppConfigsForConfig ConfigMap/Secret 变化时重新调谐引用它的 AppConfig，kind 是 configMapRef 或 secretRef
+func (r *AppConfigReconciler) findAppConfigsForConfig(kind string) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		ref := kind + "/" + obj.GetName()
+		acList := &appv1.AppConfigList{}
+		if err := r.List(ctx, acList, client.InNamespace(obj.GetNamespace()), client.MatchingFields{configRefKey: ref}); err != nil {
+			acLog.Info("failed to list appConfig", "namespace", obj.GetNamespace(), "error", err)
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(acList.Items))
+		for _, ac := range acList.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&ac)})
+		}
+		return requests
+	}
+}
+
+// getConfigRefs 返回环境变量引用的 ConfigMap/Secret，格式为 <kind>/<name>，已排序去重
+func getConfigRefs(env []corev1.EnvVar, envFrom []corev1.EnvFromSource) []string {
+	set := make(map[string]bool)
+	for _, e := range env {
+		if e.ValueFrom == nil {
+			continue
+		}
+		if e.ValueFrom.ConfigMapKeyRef != nil {
+			set[configMapRef+"/"+e.ValueFrom.ConfigMapKeyRef.Name] = true
+		}
+		if e.ValueFrom.SecretKeyRef != nil {
+			set[secretRef+"/"+e.ValueFrom.SecretKeyRef.Name] = true
+		}
+	}
+	for _, e := range envFrom {
+		if e.ConfigMapRef != nil {
+			set[configMapRef+"/"+e.ConfigMapRef.Name] = true
+		}
+		if e.SecretRef != nil {
+			set[secretRef+"/"+e.SecretRef.Name] = true
+		}
+	}
+	refs := make([]string, 0, len(set))
+	for ref := range set {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// managedEnv 上次调谐设置到 app 容器的 env 名称和 envFrom，记录在工作负载的注解上
+type managedEnv struct {
+	Env     []string `json:"env,omitempty"`
+	EnvFrom []string `json:"envFrom,omitempty"`
+}
+
+// getManagedEnv 读取工作负载上记录的 managedEnv，注解不存在或者无法解析时返回空值
+func getManagedEnv(obj client.Object) managedEnv {
+	managed := managedEnv{}
+	if v := appv1.GetAnnotation(obj, appv1.ManagedEnvAnnotation); v != appv1.NilValue {
+		_ = json.Unmarshal([]byte(v), &managed)
+	}
+	return managed
+}
+
+// setManagedEnv 在工作负载上记录 managedEnv，为空时删除注解
+func setManagedEnv(obj client.Object, managed managedEnv) {
+	key := appv1.LabelPrefix + "/" + appv1.ManagedEnvAnnotation
+	if len(managed.Env) == 0 && len(managed.EnvFrom) == 0 {
+		delete(obj.GetAnnotations(), key)
+		return
+	}
+	data, _ := json.Marshal(managed)
+	appv1.AddAnnotation(obj, appv1.ManagedEnvAnnotation, string(data))
+}
+
+// getEnvFromKey envFrom 的唯一标识，格式为 <kind>/<name>/<prefix>
+func getEnvFromKey(e corev1.EnvFromSource) string {
+	switch {
+	case e.ConfigMapRef != nil:
+		return configMapRef + "/" + e.ConfigMapRef.Name + "/" + e.Prefix
+	case e.SecretRef != nil:
+		return secretRef + "/" + e.SecretRef.Name + "/" + e.Prefix
+	}
+	return "/" + e.Prefix
+}
+
+// setContainerEnv 按名称更新容器的环境变量，envFrom 不存在时追加，
+// managed 中上次设置但已经不在配置中的条目会被删除，返回本次设置的条目
+func setContainerEnv(c *corev1.Container, env []corev1.EnvVar, envFrom []corev1.EnvFromSource, managed managedEnv) managedEnv {
+	current := managedEnv{}
+	names := make(map[string]bool)
+	for _, e := range env {
+		names[e.Name] = true
+	}
+	keys := make(map[string]bool)
+	for _, e := range envFrom {
+		keys[getEnvFromKey(e)] = true
+	}
+	stale := make(map[string]bool)
+	for _, name := range managed.Env {
+		stale[name] = !names[name]
+	}
+	if len(stale) > 0 {
+		kept := c.Env[:0]
+		for _, e := range c.Env {
+			if !stale[e.Name] {
+				kept = append(kept, e)
+			}
+		}
+		c.Env = kept
+	}
+	stale = make(map[string]bool)
+	for _, key := range managed.EnvFrom {
+		stale[key] = !keys[key]
+	}
+	if len(stale) > 0 {
+		kept := c.EnvFrom[:0]
+		for _, e := range c.EnvFrom {
+			if !stale[getEnvFromKey(e)] {
+				kept = append(kept, e)
+			}
+		}
+		c.EnvFrom = kept
+	}
+
+	for _, e := range env {
+		found := false
+		for i := range c.Env {
+			if c.Env[i].Name == e.Name {
+				c.Env[i] = e
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.Env = append(c.Env, e)
+		}
+		current.Env = append(current.Env, e.Name)
+	}
+	for _, e := range envFrom {
+		found := false
+		for _, existing := range c.EnvFrom {
+			if equality.Semantic.DeepEqual(existing, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.EnvFrom = append(c.EnvFrom, e)
+		}
+		current.EnvFrom = append(current.EnvFrom, getEnvFromKey(e))
+	}
+	return current
+}
+
+// updateConfigFiles 为 deployConfig 的配置文件创建不可变的 ConfigMap，返回 ConfigMap 名称
+func (r *AppConfigReconciler) updateConfigFiles(ctx context.Context, ac *appv1.AppConfig, dc *appv1.DeployConfig) (string, error) {
+	cf := ac.GetConfigFiles(dc)
+	if cf == nil {
+		return "", nil
+	}
+	cm := &corev1.ConfigMap{}
+	cm.SetNamespace(ac.Namespace)
+	cm.SetName(getConfigFilesName(ac.Name, cf.Files))
+	if err := r.Get(ctx, client.ObjectKeyFromObject(cm), cm); err == nil {
+		// 同名的 ConfigMap 不属于当前 AppConfig 时不能挂载，内容可能不同
+		if !metav1.IsControlledBy(cm, ac) {
+			return "", newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("configMap %s already exists and is not owned by appConfig %s", cm.Name, ac.Name))
+		}
+		return cm.Name, nil
+	} else if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	appv1.AddOtherLabel(cm, appv1.CreatedByLabel, appv1.OperatorName)
+	appv1.AddLabel(cm, appv1.ConfigLabel, getConfigLabel(ac.Name))
+	immutable := true
+	cm.Immutable = &immutable
+	cm.Data = make(map[string]string)
+	for k, v := range cf.Files {
+		cm.Data[k] = v
+	}
+	if err := ctrl.SetControllerReference(ac, cm, r.Scheme); err != nil {
+		return "", err
+	}
+	if err := r.Create(ctx, cm); client.IgnoreAlreadyExists(err) != nil {
+		return "", err
+	}
+	acLog.Info("config files created", "namespace", ac.Namespace, "name", cm.Name)
+	return cm.Name, nil
+}
+
+// cleanupConfigFiles 删除超出历史版本数量的配置文件 ConfigMap，工作负载正在使用的版本总是保留
+func (r *AppConfigReconciler) cleanupConfigFiles(ctx context.Context, ac *appv1.AppConfig, wlMap map[string]client.Object) error {
+	cmList := &corev1.ConfigMapList{}
+	// ConfigMap 不在缓存中，按标签从 API server 读取后检查 owner
+	if err := r.List(ctx, cmList, client.InNamespace(ac.Namespace),
+		client.MatchingLabels{appv1.LabelPrefix + "/" + appv1.ConfigLabel: getConfigLabel(ac.Name)}); err != nil {
+		return err
+	}
+	inUse := make(map[string]bool)
+	for _, wl := range wlMap {
+		for _, v := range getPodTemplate(wl).Spec.Volumes {
+			if v.Name == configFilesVolume && v.ConfigMap != nil {
+				inUse[v.ConfigMap.Name] = true
+			}
+		}
+	}
+	limit := getConfigFilesHistoryLimit(ac)
+
+	// 从新到旧排序，保留最近的 limit 个未使用的版本
+	cms := cmList.Items
+	sort.Slice(cms, func(i, j int) bool {
+		if cms[i].CreationTimestamp.Equal(&cms[j].CreationTimestamp) {
+			return cms[i].Name > cms[j].Name
+		}
+		return cms[j].CreationTimestamp.Before(&cms[i].CreationTimestamp)
+	})
+	kept := 0
+	for i := range cms {
+		cm := &cms[i]
+		if !metav1.IsControlledBy(cm, ac) || inUse[cm.Name] {
+			continue
+		}
+		if kept < limit {
+			kept++
+			continue
+		}
+		acLog.V(1).Info("delete config files", "namespace", ac.Namespace, "name", cm.Name)
+		if err := r.Delete(ctx, cm); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getConfigFilesHistoryLimit 同样内容的配置文件在 deployConfig 之间共用 ConfigMap，
+// 按所有 deployConfig 中最大的历史版本数量保留，保证每个 deployConfig 的设置都能满足
+func getConfigFilesHistoryLimit(ac *appv1.AppConfig) int {
+	limit := -1
+	for i := range ac.Spec.DeployConfigs {
+		if cf := ac.GetConfigFiles(&ac.Spec.DeployConfigs[i]); cf != nil && cf.GetRevisionHistoryLimit() > limit {
+			limit = cf.GetRevisionHistoryLimit()
+		}
+	}
+	if limit >= 0 {
+		return limit
+	}
+	// 配置文件都已移除时保留默认数量
+	return (&appv1.ConfigFiles{}).GetRevisionHistoryLimit()
+}
+
+// getConfigLabel 配置文件 ConfigMap 的 config 标签值，和名称一样截断到 63 个字符
+func getConfigLabel(name string) string {
+	if len(name) > maxNameLength {
+		name = strings.TrimRight(name[:maxNameLength], "-.")
+	}
+	return name
+}
+
+// getConfigFilesName ConfigMap 名称为 <appConfig>-config-<hash>
+func getConfigFilesName(name string, files map[string]string) string {
+	keys := make([]string, 0, len(files))
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%x\n", k, files[k])
+	}
+	suffix := "-config-" + hex.EncodeToString(h.Sum(nil))[:10]
+	if len(name) > maxNameLength-len(suffix) {
+		name = name[:maxNameLength-len(suffix)]
+	}
+	return name + suffix
+}
+
+// setConfigFilesVolume 挂载配置文件 ConfigMap 到 app 容器，没有配置文件时移除
+func setConfigFilesVolume(tmpl *corev1.PodTemplateSpec, pc *podConfig) {
+	var volumes []corev1.Volume
+	for _, v := range tmpl.Spec.Volumes {
+		if v.Name != configFilesVolume {
+			volumes = append(volumes, v)
+		}
+	}
+	tmpl.Spec.Volumes = volumes
+	for i, c := range tmpl.Spec.Containers {
+		if c.Name != appName {
+			continue
+		}
+		var mounts []corev1.VolumeMount
+		for _, vm := range c.VolumeMounts {
+			if vm.Name != configFilesVolume {
+				mounts = append(mounts, vm)
+			}
+		}
+		tmpl.Spec.Containers[i].VolumeMounts = mounts
+		if pc.configFiles != appv1.NilValue {
+			setVolumeMount(configFilesVolume, pc.configMountPath, &tmpl.Spec.Containers[i])
+		}
+	}
+	if pc.configFiles != appv1.NilValue {
+		tmpl.Spec.Volumes = append(tmpl.Spec.Volumes, corev1.Volume{
+			Name: configFilesVolume,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: pc.configFiles},
+				},
+			},
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateConfigFiles(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{"app.yaml": "debug: false"}
+	newAppConfig := func(name string) *appv1.AppConfig {
+		ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: "demo"}}
+		ac.Spec.DeployConfigs = []appv1.DeployConfig{{Name: "demo", Type: appv1.StableDeploy, Image: "app:v1"}}
+		ac.Spec.ConfigFiles = &appv1.ConfigFiles{MountPath: "/etc/app", Files: files}
+		return ac
+	}
+	// 其他 AppConfig 创建的同名 ConfigMap
+	other := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: getConfigFilesName("demo", files), Namespace: "default"}}
+	if err := ctrl.SetControllerReference(&appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default", UID: "other"}}, other, s); err != nil {
+		t.Fatal(err)
+	}
+	longName := strings.Repeat("a", 70)
+
+	tests := []struct {
+		name       string
+		ac         *appv1.AppConfig
+		objs       []client.Object
+		wantLabel  string
+		wantReason string
+	}{
+		{name: "create", ac: newAppConfig("demo"), wantLabel: "demo"},
+		{name: "long name", ac: newAppConfig(longName), wantLabel: longName[:maxNameLength]},
+		{name: "not owned", ac: newAppConfig("demo"), objs: []client.Object{other}, wantReason: appv1.InvalidConfigReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &AppConfigReconciler{Client: fake.NewClientBuilder().WithScheme(s).WithObjects(tt.objs...).Build(), Scheme: s}
+			ctx := context.Background()
+			name, err := r.updateConfigFiles(ctx, tt.ac, &tt.ac.Spec.DeployConfigs[0])
+			if tt.wantReason != "" {
+				if reason, _ := permanentReason(err); reason != tt.wantReason {
+					t.Fatalf("updateConfigFiles() error = %v, want reason %s", err, tt.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cm := &corev1.ConfigMap{}
+			if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, cm); err != nil {
+				t.Fatal(err)
+			}
+			if got := appv1.GetLabel(cm, appv1.ConfigLabel); got != tt.wantLabel {
+				t.Errorf("config label = %q, want %q", got, tt.wantLabel)
+			}
+			// 已经存在时直接使用
+			if again, err := r.updateConfigFiles(ctx, tt.ac, &tt.ac.Spec.DeployConfigs[0]); err != nil || again != name {
+				t.Errorf("updateConfigFiles() = %s, %v, want %s", again, err, name)
+			}
+		})
+	}
+}
+
+func TestCleanupConfigFiles(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	limit := func(n int32) *int32 { return &n }
+	newAppConfig := func(stableLimit, canaryLimit *int32) *appv1.AppConfig {
+		ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+		ac.Spec.ConfigFiles = &appv1.ConfigFiles{MountPath: "/etc/app", Files: map[string]string{"app.yaml": "v5"}}
+		ac.Spec.DeployConfigs = []appv1.DeployConfig{
+			{Name: "demo-stable", Type: appv1.StableDeploy, Image: "app:v1"},
+			{Name: "demo-canary", Type: appv1.CanaryDeploy, Image: "app:v1"},
+		}
+		if stableLimit != nil {
+			ac.Spec.DeployConfigs[0].ConfigFiles = &appv1.ConfigFiles{MountPath: "/etc/app", Files: map[string]string{"app.yaml": "v5"}, RevisionHistoryLimit: stableLimit}
+		}
+		if canaryLimit != nil {
+			ac.Spec.DeployConfigs[1].ConfigFiles = &appv1.ConfigFiles{MountPath: "/etc/app", Files: map[string]string{"app.yaml": "v5"}, RevisionHistoryLimit: canaryLimit}
+		}
+		return ac
+	}
+	// demo-config-0 最旧，demo-config-4 最新并且正在使用
+	var cms []client.Object
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:              fmt.Sprintf("demo-config-%d", i),
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(now.Add(time.Duration(i) * time.Minute)),
+		}}
+		appv1.AddLabel(cm, appv1.ConfigLabel, "demo")
+		if err := ctrl.SetControllerReference(newAppConfig(nil, nil), cm, s); err != nil {
+			t.Fatal(err)
+		}
+		cms = append(cms, cm)
+	}
+	dm := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo-stable", Namespace: "default"}}
+	dm.Spec.Template.Spec.Volumes = []corev1.Volume{{Name: configFilesVolume, VolumeSource: corev1.VolumeSource{
+		ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "demo-config-4"}},
+	}}}
+
+	tests := []struct {
+		name string
+		ac   *appv1.AppConfig
+		want []string
+	}{
+		{name: "default limit", ac: newAppConfig(nil, nil), want: []string{"demo-config-0", "demo-config-1", "demo-config-2", "demo-config-3", "demo-config-4"}},
+		{name: "deployConfig limit", ac: newAppConfig(limit(1), limit(1)), want: []string{"demo-config-3", "demo-config-4"}},
+		{name: "largest deployConfig limit", ac: newAppConfig(limit(0), limit(2)), want: []string{"demo-config-2", "demo-config-3", "demo-config-4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := make([]client.Object, 0, len(cms))
+			for _, cm := range cms {
+				objs = append(objs, cm.DeepCopyObject().(client.Object))
+			}
+			r := &AppConfigReconciler{Client: fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build(), Scheme: s}
+			ctx := context.Background()
+			if err := r.cleanupConfigFiles(ctx, tt.ac, map[string]client.Object{dm.Name: dm}); err != nil {
+				t.Fatal(err)
+			}
+			cmList := &corev1.ConfigMapList{}
+			if err := r.List(ctx, cmList); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, cm := range cmList.Items {
+				got = append(got, cm.Name)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("config files = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// updateCronJobs 创建或更新定时任务，删除已经不在配置中的定时任务
+func (r *AppConfigReconciler) updateCronJobs(ctx context.Context, ac *appv1.AppConfig) error {
+	cjList := &batchv1.CronJobList{}
+	if err := r.List(ctx, cjList, client.InNamespace(ac.Namespace), client.MatchingFields{ownerKey: ac.Name}); err != nil {
+		return err
+	}
+	if len(ac.Spec.BatchJobs) == 0 && len(cjList.Items) == 0 {
+		return nil
+	}
+
+	// 定时任务使用 stable 渲染后的 Pod 配置，跟随 stable 当前实际运行的镜像，stable 还没有创建时使用配置的镜像
+	tmpl := &corev1.PodTemplateSpec{}
+	if stable, ok := ac.GetDeployConfig(appv1.StableDeploy); ok {
+		if ds, ok := getDeployStatus(appv1.StableDeploy, ac.Status.DeployStatus); ok && ds.Image != appv1.NilValue {
+			stable.Image = ds.Image
+		}
+		var err error
+		if tmpl, err = r.renderPodTemplate(ctx, ac, &stable); err != nil {
+			return err
+		}
+	}
+	podSpec := getJobPodSpec(tmpl, corev1.RestartPolicyOnFailure)
+
+	names := make(map[string]bool)
+	for _, bj := range ac.Spec.BatchJobs {
+		cj := &batchv1.CronJob{}
+		cj.SetNamespace(ac.Namespace)
+		cj.SetName(getCronJobName(ac, &bj))
+		names[cj.Name] = true
+		res, err := controllerutil.CreateOrUpdate(ctx, r.Client, cj, r.setCronJob(cj, ac, &bj, podSpec))
+		if err != nil {
+			return err
+		}
+		acLog.V(1).Info("cronjob updated", "namespace", ac.Namespace, "name", cj.Name, "result", res)
+	}
+
+	for i := range cjList.Items {
+		cj := &cjList.Items[i]
+		if names[cj.Name] {
+			continue
+		}
+		acLog.Info("delete cronjob", "namespace", ac.Namespace, "name", cj.Name)
+		if err := r.Delete(ctx, cj); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *AppConfigReconciler) setCronJob(cj *batchv1.CronJob, ac *appv1.AppConfig, bj *appv1.BatchJob, podSpec corev1.PodSpec) controllerutil.MutateFn {
+	return func() error {
+		cj.Labels = make(map[string]string)
+		appv1.AddOtherLabel(cj, appName, cj.Name)
+		appv1.AddOtherLabel(cj, appv1.CreatedByLabel, appv1.OperatorName)
+
+		cj.Spec.Schedule = bj.Schedule
+		cj.Spec.ConcurrencyPolicy = bj.ConcurrencyPolicy
+		if cj.Spec.ConcurrencyPolicy == "" {
+			cj.Spec.ConcurrencyPolicy = batchv1.AllowConcurrent
+		}
+		cj.Spec.SuccessfulJobsHistoryLimit = bj.SuccessfulJobsHistoryLimit
+		cj.Spec.FailedJobsHistoryLimit = bj.FailedJobsHistoryLimit
+		cj.Spec.Suspend = bj.Suspend
+
+		tmpl := &cj.Spec.JobTemplate.Spec.Template
+		tmpl.Labels = make(map[string]string)
+		appv1.AddOtherLabel(tmpl, appName, cj.Name)
+		// 只替换 app 容器的命令和参数
+		spec := *podSpec.DeepCopy()
+		if len(spec.Containers) == 0 {
+			spec.Containers = []corev1.Container{{Name: appName}}
+		}
+		spec.Containers[0].Command = bj.Command
+		spec.Containers[0].Args = bj.Args
+		hash, err := getObjectHash(spec)
+		if err != nil {
+			return err
+		}
+		if appv1.GetAnnotation(cj, appv1.PodSpecHashAnnotation) != hash {
+			tmpl.Spec = spec
+			appv1.AddAnnotation(cj, appv1.PodSpecHashAnnotation, hash)
+		}
+
+		return ctrl.SetControllerReference(ac, cj, r.Scheme)
+	}
+}
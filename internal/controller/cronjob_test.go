@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestUpdateCronJobs(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+	appv1.AddAnnotation(ac, appv1.DeploymentConfigAnnotation, `{"spec":{"template":{"spec":{"serviceAccountName":"demo","imagePullSecrets":[{"name":"regcred"}]}}}}`)
+	ac.Spec.DeployConfigs = []appv1.DeployConfig{{
+		Name:    "demo",
+		Type:    appv1.StableDeploy,
+		Image:   "app:v2",
+		Env:     []corev1.EnvVar{{Name: "MODE", Value: "prod"}},
+		EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "demo-env"}}}},
+		ConfigFiles: &appv1.ConfigFiles{
+			MountPath: "/etc/app",
+			Files:     map[string]string{"app.yaml": "debug: false"},
+		},
+		ContainerConfig: appv1.ContainerConfig{
+			LivenessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{}}},
+			Resources:     &corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}},
+		},
+	}}
+	ac.Spec.BatchJobs = []appv1.BatchJob{{Name: "report", Schedule: "0 * * * *", Command: []string{"report"}, Args: []string{"--daily"}}}
+	// stable 还在运行旧镜像
+	ac.Status.DeployStatus = []appv1.DeployStatus{{Type: appv1.StableDeploy, Image: "app:v1"}}
+
+	c := fake.NewClientBuilder().WithScheme(s).WithObjects(ac)
+	for _, obj := range []client.Object{&batchv1.CronJob{}, &corev1.ConfigMap{}} {
+		c = c.WithIndex(obj, ownerKey, func(obj client.Object) []string {
+			if owner := metav1.GetControllerOf(obj); owner != nil {
+				return []string{owner.Name}
+			}
+			return nil
+		})
+	}
+	r := &AppConfigReconciler{Client: c.Build(), Scheme: s, Recorder: record.NewFakeRecorder(10)}
+	ctx := context.Background()
+	if err := r.updateCronJobs(ctx, ac); err != nil {
+		t.Fatal(err)
+	}
+
+	cj := &batchv1.CronJob{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "demo-report"}, cj); err != nil {
+		t.Fatal(err)
+	}
+	spec := cj.Spec.JobTemplate.Spec.Template.Spec
+	if spec.ServiceAccountName != "demo" || len(spec.ImagePullSecrets) != 1 || spec.ImagePullSecrets[0].Name != "regcred" {
+		t.Errorf("serviceAccount = %q, imagePullSecrets = %v", spec.ServiceAccountName, spec.ImagePullSecrets)
+	}
+	if spec.RestartPolicy != corev1.RestartPolicyOnFailure {
+		t.Errorf("restartPolicy = %s, want OnFailure", spec.RestartPolicy)
+	}
+	if len(spec.Volumes) != 1 || spec.Volumes[0].Name != configFilesVolume {
+		t.Errorf("volumes = %v, want config files volume", spec.Volumes)
+	}
+	if len(spec.Containers) != 1 {
+		t.Fatalf("containers = %v, want app container", spec.Containers)
+	}
+	container := spec.Containers[0]
+	if container.Image != "app:v1" {
+		t.Errorf("image = %s, want app:v1", container.Image)
+	}
+	if len(container.Command) != 1 || container.Command[0] != "report" || len(container.Args) != 1 || container.Args[0] != "--daily" {
+		t.Errorf("command = %v, args = %v", container.Command, container.Args)
+	}
+	if len(container.Env) != 1 || container.Env[0].Name != "MODE" || len(container.EnvFrom) != 1 {
+		t.Errorf("env = %v, envFrom = %v", container.Env, container.EnvFrom)
+	}
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != "/etc/app" {
+		t.Errorf("volumeMounts = %v", container.VolumeMounts)
+	}
+	if container.Resources.Limits.Memory().String() != "1Gi" {
+		t.Errorf("resources = %v", container.Resources)
+	}
+	if container.LivenessProbe != nil {
+		t.Error("job container should not have liveness probe")
+	}
+	if cj.Spec.JobTemplate.Spec.Template.Labels[appName] != "demo-report" {
+		t.Errorf("pod labels = %v", cj.Spec.JobTemplate.Spec.Template.Labels)
+	}
+
+	// 配置没有变化时保留 API server 设置的默认值
+	cj.Spec.JobTemplate.Spec.Template.Spec.Containers[0].ImagePullPolicy = corev1.PullIfNotPresent
+	if err := r.Update(ctx, cj); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.updateCronJobs(ctx, ac); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(cj), cj); err != nil {
+		t.Fatal(err)
+	}
+	if policy := cj.Spec.JobTemplate.Spec.Template.Spec.Containers[0].ImagePullPolicy; policy != corev1.PullIfNotPresent {
+		t.Errorf("imagePullPolicy = %s, want defaults kept", policy)
+	}
+
+	// stable 发布完成后跟随新镜像
+	ac.Status.DeployStatus[0].Image = "app:v2"
+	if err := r.updateCronJobs(ctx, ac); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(cj), cj); err != nil {
+		t.Fatal(err)
+	}
+	if image := cj.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Image; image != "app:v2" {
+		t.Errorf("image = %s, want app:v2", image)
+	}
+}
@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"gomodules.xyz/jsonpatch/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"strings"
+)
+
+type ChangeOperation string
+
+const (
+	CreateChange ChangeOperation = "create"
+	UpdateChange ChangeOperation = "update"
+	DeleteChange ChangeOperation = "delete"
+)
+
+// 模拟调谐中阻止更新的条件
+const (
+	pausedGate        = "paused"
+	strictReleaseGate = "strict-release"
+	strictUpdateGate  = "strict-update"
+	freezeWindowGate  = "freeze-window"
+	preHookGate       = "pre-hook"
+)
+
+// DryRunResult 模拟调谐的结果
+type DryRunResult struct {
+	// Changes 调谐会执行的写操作，按执行顺序排列
+	Changes []ResourceChange `json:"changes"`
+	// Blocked 阻止更新的条件，永久错误以错误原因作为条件名称
+	Blocked []BlockedGate `json:"blocked"`
+}
+
+type ResourceChange struct {
+	Kind      string          `json:"kind"`
+	Name      string          `json:"name"`
+	Operation ChangeOperation `json:"operation"`
+	// Patch update 时从当前对象到渲染结果的 RFC 6902 JSON patch
+	Patch []jsonpatch.Operation `json:"patch,omitempty"`
+	// Object create 时渲染的完整对象
+	Object json.RawMessage `json:"object,omitempty"`
+}
+
+type BlockedGate struct {
+	Gate string `json:"gate"`
+	// Deploy 被阻止的 deployConfig，为空时阻止整个 AppConfig
+	Deploy  string `json:"deploy,omitempty"`
+	Message string `json:"message"`
+}
+
+// DryRun 使用当前的全局模板和集群状态模拟调谐 AppConfig，返回会产生的变更和阻止更新的条件，不修改任何资源
+// AppConfig 已存在时使用集群中的状态
+func (r *AppConfigReconciler) DryRun(ctx context.Context, ac *appv1.AppConfig) (*DryRunResult, error) {
+	ac = ac.DeepCopy()
+	if err := r.loadTemplate(ctx); err != nil {
+		return nil, err
+	}
+	live := &appv1.AppConfig{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(ac), live); err == nil {
+		ac.UID = live.UID
+		ac.ResourceVersion = live.ResourceVersion
+		ac.Generation = live.Generation
+		ac.Status = live.Status
+	} else if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	result := &DryRunResult{Changes: []ResourceChange{}, Blocked: []BlockedGate{}}
+	dr := &AppConfigReconciler{
+		Client:   &dryRunClient{Client: r.Client, ac: ac, result: result},
+		Scheme:   r.Scheme,
+		Recorder: &record.FakeRecorder{},
+		Registry: r.Registry,
+		dryRun:   result,
+	}
+	if err := dr.simulate(ctx, ac); err != nil {
+		reason, ok := permanentReason(err)
+		if !ok {
+			return nil, err
+		}
+		dr.blockedBy(reason, "", err.Error())
+	}
+	return result, nil
+}
+
+// simulate 和 Reconcile 相同的更新流程，不包含镜像自动更新和手动发布操作
+func (r *AppConfigReconciler) simulate(ctx context.Context, ac *appv1.AppConfig) error {
+	if err := r.applyPolicy(ctx, ac); err != nil {
+		return err
+	}
+	if err := r.resolveImages(ctx, ac); err != nil {
+		return err
+	}
+	wlMap, err := r.listWorkload(ctx, ac)
+	if err != nil {
+		return err
+	}
+	if err := r.updateStatus(ctx, ac, wlMap); err != nil {
+		return err
+	}
+	if ac.Spec.Paused {
+		r.blockedBy(pausedGate, "", "appConfig is paused")
+		return nil
+	}
+	if _, err := r.updateDeploy(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ac)}, ac, wlMap); err != nil {
+		return err
+	}
+	return r.updateCronJobs(ctx, ac)
+}
+
+// blockedBy 模拟调谐时记录阻止更新的条件，正常调谐时不做任何事
+func (r *AppConfigReconciler) blockedBy(gate, deploy, message string) {
+	if r.dryRun == nil {
+		return
+	}
+	r.dryRun.Blocked = append(r.dryRun.Blocked, BlockedGate{Gate: gate, Deploy: deploy, Message: message})
+}
+
+// dryRunClient 从集群读取，记录写操作但不执行，读取模拟的 AppConfig 时返回内存中的对象
+type dryRunClient struct {
+	client.Client
+	ac     *appv1.AppConfig
+	result *DryRunResult
+}
+
+func (c *dryRunClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if ac, ok := obj.(*appv1.AppConfig); ok && key == client.ObjectKeyFromObject(c.ac) {
+		c.ac.DeepCopyInto(ac)
+		return nil
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func (c *dryRunClient) Create(ctx context.Context, obj client.Object, _ ...client.CreateOption) error {
+	return c.record(ctx, CreateChange, obj)
+}
+
+func (c *dryRunClient) Update(ctx context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	return c.record(ctx, UpdateChange, obj)
+}
+
+func (c *dryRunClient) Patch(ctx context.Context, obj client.Object, _ client.Patch, _ ...client.PatchOption) error {
+	return c.record(ctx, UpdateChange, obj)
+}
+
+func (c *dryRunClient) Delete(ctx context.Context, obj client.Object, _ ...client.DeleteOption) error {
+	return c.record(ctx, DeleteChange, obj)
+}
+
+func (c *dryRunClient) DeleteAllOf(context.Context, client.Object, ...client.DeleteAllOfOption) error {
+	return nil
+}
+
+// Status 模拟的状态只保存在内存中
+func (c *dryRunClient) Status() client.SubResourceWriter {
+	return dryRunStatusWriter{}
+}
+
+func (c *dryRunClient) record(ctx context.Context, op ChangeOperation, obj client.Object) error {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return err
+	}
+	change := ResourceChange{Kind: gvk.Kind, Name: obj.GetName(), Operation: op}
+	switch op {
+	case CreateChange:
+		if change.Object, err = json.Marshal(obj); err != nil {
+			return err
+		}
+	case UpdateChange:
+		live := obj.DeepCopyObject().(client.Object)
+		if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), live); err != nil {
+			return err
+		}
+		if change.Patch, err = diffObjects(live, obj); err != nil {
+			return err
+		}
+	}
+	c.result.Changes = append(c.result.Changes, change)
+	return nil
+}
+
+func diffObjects(from, to client.Object) ([]jsonpatch.Operation, error) {
+	fromJSON, err := json.Marshal(from)
+	if err != nil {
+		return nil, err
+	}
+	toJSON, err := json.Marshal(to)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := jsonpatch.CreatePatch(fromJSON, toJSON)
+	if err != nil {
+		return nil, err
+	}
+	// 只保留调谐会修改的字段
+	patch := make([]jsonpatch.Operation, 0, len(ops))
+	for _, op := range ops {
+		if op.Path == "/metadata/resourceVersion" || strings.HasPrefix(op.Path, "/metadata/managedFields") || strings.HasPrefix(op.Path, "/status") {
+			continue
+		}
+		patch = append(patch, op)
+	}
+	return patch, nil
+}
+
+type dryRunStatusWriter struct{}
+
+func (dryRunStatusWriter) Create(context.Context, client.Object, client.Object, ...client.SubResourceCreateOption) error {
+	return nil
+}
+
+func (dryRunStatusWriter) Update(context.Context, client.Object, ...client.SubResourceUpdateOption) error {
+	return nil
+}
+
+func (dryRunStatusWriter) Patch(context.Context, client.Object, client.Patch, ...client.SubResourcePatchOption) error {
+	return nil
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sync"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	newAppConfig := func(stableImage, canaryImage string) *appv1.AppConfig {
+		ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+		ac.Spec.DeployConfigs = []appv1.DeployConfig{
+			{Name: "demo-stable", Type: appv1.StableDeploy, Image: stableImage},
+			{Name: "demo-canary", Type: appv1.CanaryDeploy, Image: canaryImage},
+		}
+		return ac
+	}
+	live := newAppConfig("app:v1", "app:v1")
+	stable := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo-stable", Namespace: "default"}}
+	stable.Spec.Template.Spec.Containers = []corev1.Container{{Name: appName, Image: "app:v1"}}
+	if err := ctrl.SetControllerReference(live, stable, s); err != nil {
+		t.Fatal(err)
+	}
+
+	strict := newAppConfig("app:v2", "app:v2")
+	appv1.AddAnnotation(strict, appv1.StrictReleaseAnnotation, appv1.TureValue)
+	paused := newAppConfig("app:v2", "app:v2")
+	paused.Spec.Paused = true
+
+	tests := []struct {
+		name        string
+		ac          *appv1.AppConfig
+		wantChanges []ResourceChange
+		wantBlocked []BlockedGate
+	}{
+		{
+			name: "update stable and create canary",
+			ac:   newAppConfig("app:v2", "app:v2"),
+			wantChanges: []ResourceChange{
+				{Kind: "Deployment", Name: "demo-canary", Operation: CreateChange},
+				{Kind: "Deployment", Name: "demo-stable", Operation: UpdateChange},
+			},
+		},
+		{
+			name: "strict release blocks stable",
+			ac:   strict,
+			wantChanges: []ResourceChange{
+				{Kind: "Deployment", Name: "demo-canary", Operation: CreateChange},
+			},
+			wantBlocked: []BlockedGate{{Gate: strictReleaseGate, Deploy: "demo-stable"}},
+		},
+		{
+			name:        "paused",
+			ac:          paused,
+			wantBlocked: []BlockedGate{{Gate: pausedGate}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithScheme(s).WithObjects(live.DeepCopy(), stable.DeepCopy()).
+				WithStatusSubresource(&appv1.AppConfig{})
+			for _, obj := range []client.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}, &batchv1.Job{}, &batchv1.CronJob{}, &corev1.ConfigMap{}} {
+				c = c.WithIndex(obj, ownerKey, func(obj client.Object) []string {
+					if owner := metav1.GetControllerOf(obj); owner != nil {
+						return []string{owner.Name}
+					}
+					return nil
+				})
+			}
+			r := &AppConfigReconciler{Client: c.Build(), Scheme: s, Recorder: record.NewFakeRecorder(10)}
+
+			result, err := r.DryRun(context.Background(), tt.ac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Changes) != len(tt.wantChanges) {
+				t.Fatalf("got changes %+v, want %+v", result.Changes, tt.wantChanges)
+			}
+			for i, want := range tt.wantChanges {
+				got := result.Changes[i]
+				if got.Kind != want.Kind || got.Name != want.Name || got.Operation != want.Operation {
+					t.Errorf("change %d = %s %s/%s, want %s %s/%s", i, got.Operation, got.Kind, got.Name, want.Operation, want.Kind, want.Name)
+				}
+				if got.Operation == UpdateChange && len(got.Patch) == 0 {
+					t.Errorf("change %d has no patch", i)
+				}
+				if got.Operation == CreateChange && len(got.Object) == 0 {
+					t.Errorf("change %d has no object", i)
+				}
+			}
+			if len(result.Blocked) != len(tt.wantBlocked) {
+				t.Fatalf("got blocked %+v, want %+v", result.Blocked, tt.wantBlocked)
+			}
+			for i, want := range tt.wantBlocked {
+				if got := result.Blocked[i]; got.Gate != want.Gate || got.Deploy != want.Deploy {
+					t.Errorf("blocked %d = %s/%s, want %s/%s", i, got.Gate, got.Deploy, want.Gate, want.Deploy)
+				}
+			}
+
+			// 不修改任何资源
+			dmList := &appsv1.DeploymentList{}
+			if err := r.List(context.Background(), dmList); err != nil {
+				t.Fatal(err)
+			}
+			if len(dmList.Items) != 1 || dmList.Items[0].Spec.Template.Spec.Containers[0].Image != "app:v1" {
+				t.Errorf("deployments changed: %+v", dmList.Items)
+			}
+			ac := &appv1.AppConfig{}
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(live), ac); err != nil {
+				t.Fatal(err)
+			}
+			if len(ac.Status.DeployStatus) != 0 {
+				t.Errorf("status changed: %+v", ac.Status)
+			}
+		})
+	}
+}
+
+func TestLoadTemplateConcurrent(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-template", Namespace: "default"},
+		Data:       map[string]string{"deployment": "spec:\n  revisionHistoryLimit: 3\n"},
+	}
+	oldPath := templatePath
+	templatePath = "default/app-template"
+	defer func() { templatePath = oldPath; templateCM.Store(nil) }()
+	r := &AppConfigReconciler{Client: fake.NewClientBuilder().WithScheme(s).WithObjects(tmpl).Build(), Scheme: s}
+
+	// 调谐和 dry-run API 同时加载、读取模板，go test -race 不应报告数据竞争
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := r.loadTemplate(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			getTemplate("deployment")
+		}()
+	}
+	wg.Wait()
+	if got, ok := getTemplate("deployment"); !ok || got != tmpl.Data["deployment"] {
+		t.Errorf("getTemplate() = %q, %v", got, ok)
+	}
+}
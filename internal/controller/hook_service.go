@@ -0,0 +1,215 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+// runHooks 为 stable 镜像版本执行指定阶段的 hook，返回是否全部执行结束
+// pre hook 失败时返回永久错误，阻止 stable 更新；post hook 失败时只在状态和事件中记录一次，不影响后续调谐
+func (r *AppConfigReconciler) runHooks(ctx context.Context, ac *appv1.AppConfig, phase appv1.HookPhase, image string) (bool, error) {
+	hooks := getHooks(phase, ac.Spec.Hooks)
+	if len(hooks) == 0 {
+		return true, nil
+	}
+
+	revision := getRevision(image)
+	var statuses []appv1.HookStatus
+	for _, hs := range ac.Status.Hooks {
+		if hs.Phase != phase {
+			statuses = append(statuses, hs)
+		}
+	}
+	done := true
+	var failed []string
+	var tmpl *corev1.PodTemplateSpec
+	for _, hook := range hooks {
+		job := &batchv1.Job{}
+		key := client.ObjectKey{Namespace: ac.Namespace, Name: getHookJobName(ac, &hook, revision)}
+		err := r.Get(ctx, key, job)
+		if apierrors.IsNotFound(err) {
+			// hook 使用 stable 以新镜像渲染的 Pod 配置
+			if tmpl == nil {
+				stable, _ := ac.GetDeployConfig(appv1.StableDeploy)
+				stable.Image = image
+				if tmpl, err = r.renderPodTemplate(ctx, ac, &stable); err != nil {
+					return false, err
+				}
+			}
+			job = r.newHookJob(ac, &hook, key.Name, image, revision, tmpl)
+			if err := ctrl.SetControllerReference(ac, job, r.Scheme); err != nil {
+				return false, err
+			}
+			if err := r.Create(ctx, job); err != nil {
+				return false, err
+			}
+			acLog.Info("hook job created", "namespace", ac.Namespace, "name", job.Name, "phase", phase, "image", image)
+			r.Recorder.Eventf(ac, corev1.EventTypeNormal, "HookStarted", "%s hook %s started for image %s", phase, hook.Name, image)
+		} else if err != nil {
+			return false, err
+		}
+
+		result := getHookResult(job)
+		switch result {
+		case appv1.HookRunning:
+			done = false
+		case appv1.HookFailed:
+			failed = append(failed, hook.Name)
+			// 只在第一次发现失败时记录事件
+			if hs, ok := getHookStatus(hook.Name, phase, ac.Status.Hooks); !ok || hs.Image != image || hs.Result != appv1.HookFailed {
+				acLog.Info("hook job failed", "namespace", ac.Namespace, "name", job.Name, "phase", phase, "image", image)
+				r.Recorder.Eventf(ac, corev1.EventTypeWarning, appv1.HookFailedReason, "%s hook %s failed for image %s", phase, hook.Name, image)
+			}
+		}
+		statuses = append(statuses, appv1.HookStatus{
+			Name:   hook.Name,
+			Phase:  phase,
+			Image:  image,
+			Job:    job.Name,
+			Result: result,
+		})
+	}
+
+	status := ac.Status.DeepCopy()
+	status.Hooks = statuses
+	if err := r.patchStatus(ctx, ac, *status); err != nil {
+		return false, err
+	}
+	if len(failed) > 0 && phase == appv1.PreHook {
+		return false, newPermanentError(appv1.HookFailedReason, fmt.Errorf("%s hook %s failed for image %s", phase, strings.Join(failed, ","), image))
+	}
+	return done, nil
+}
+
+// cleanupHookJobs 删除不是当前 stable 镜像版本的 hook Job
+func (r *AppConfigReconciler) cleanupHookJobs(ctx context.Context, ac *appv1.AppConfig) error {
+	jobList := &batchv1.JobList{}
+	if err := r.List(ctx, jobList, client.InNamespace(ac.Namespace), client.MatchingFields{ownerKey: ac.Name}); err != nil {
+		return err
+	}
+	revision := ""
+	if stable, ok := ac.GetDeployConfig(appv1.StableDeploy); ok {
+		revision = getRevision(stable.Image)
+	}
+	for i := range jobList.Items {
+		job := &jobList.Items[i]
+		if job.Labels[appv1.LabelPrefix+"/"+appv1.RevisionLabel] == revision {
+			continue
+		}
+		acLog.V(1).Info("delete hook job", "namespace", ac.Namespace, "name", job.Name)
+		if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newHookJob 基于渲染后的 stable Pod 模板创建 hook Job，hook 容器中设置的字段覆盖 app 容器
+// 环境变量和挂载追加在 app 容器之后，命令和参数总是使用 hook 的配置
+func (r *AppConfigReconciler) newHookJob(ac *appv1.AppConfig, hook *appv1.Hook, name, image, revision string, tmpl *corev1.PodTemplateSpec) *batchv1.Job {
+	job := &batchv1.Job{}
+	job.SetNamespace(ac.Namespace)
+	job.SetName(name)
+	appv1.AddOtherLabel(job, appv1.CreatedByLabel, appv1.OperatorName)
+	appv1.AddLabel(job, appv1.HookLabel, hook.Name)
+	appv1.AddLabel(job, appv1.RevisionLabel, revision)
+
+	job.Spec.BackoffLimit = new(int32)
+	if hook.BackoffLimit != nil {
+		*job.Spec.BackoffLimit = *hook.BackoffLimit
+	}
+	if hook.Timeout != nil {
+		deadline := int64(hook.Timeout.Seconds())
+		job.Spec.ActiveDeadlineSeconds = &deadline
+	}
+	// hook pod 不注入 sidecar，去掉注入相关的注解并关闭注入
+	job.Spec.Template.Annotations = make(map[string]string)
+	for k, v := range tmpl.Annotations {
+		job.Spec.Template.Annotations[k] = v
+	}
+	for _, k := range []string{appv1.ContainersInjectionAnnotation, appv1.SidecarProfileAnnotation, appv1.InjectedProfileAnnotation, appv1.InjectedProfileVersionAnnotation} {
+		delete(job.Spec.Template.Annotations, appv1.LabelPrefix+"/"+k)
+	}
+	job.Spec.Template.Labels = make(map[string]string)
+	appv1.AddLabel(&job.Spec.Template, appv1.HookLabel, hook.Name)
+	appv1.AddLabel(&job.Spec.Template, appv1.InjectionLabel, appv1.DisabledValue)
+	job.Spec.Template.Spec = getJobPodSpec(tmpl, corev1.RestartPolicyNever)
+	job.Spec.Template.Spec.Containers = []corev1.Container{newHookContainer(job.Spec.Template.Spec.Containers, hook, image)}
+	return job
+}
+
+// newHookContainer 合并 app 容器和 hook 容器
+func newHookContainer(containers []corev1.Container, hook *appv1.Hook, image string) corev1.Container {
+	app := &corev1.Container{Image: image}
+	if len(containers) > 0 {
+		app = containers[0].DeepCopy()
+	}
+	container := *app.DeepCopy()
+	env, envFrom, mounts := app.Env, app.EnvFrom, app.VolumeMounts
+	// 没有设置的字段在 JSON 中被省略，不会覆盖 app 容器
+	if data, err := json.Marshal(hook.Container); err == nil {
+		_ = json.Unmarshal(data, &container)
+	}
+	container.Env = env
+	container.EnvFrom = envFrom
+	setContainerEnv(&container, hook.Container.Env, hook.Container.EnvFrom, managedEnv{})
+	container.VolumeMounts = append(mounts, hook.Container.VolumeMounts...)
+	container.Command = hook.Container.Command
+	container.Args = hook.Container.Args
+	if container.Name == appv1.NilValue {
+		container.Name = appv1.HookLabel
+	}
+	return container
+}
+
+func getHooks(phase appv1.HookPhase, hooks []appv1.Hook) []appv1.Hook {
+	var list []appv1.Hook
+	for _, hook := range hooks {
+		if hook.Phase == phase {
+			list = append(list, hook)
+		}
+	}
+	return list
+}
+
+func getHookResult(job *batchv1.Job) appv1.HookResult {
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return appv1.HookSucceeded
+		case batchv1.JobFailed:
+			return appv1.HookFailed
+		}
+	}
+	return appv1.HookRunning
+}
+
+// getHookJobName Job 名称为 <appConfig>-<hook>-<revision>
+func getHookJobName(ac *appv1.AppConfig, hook *appv1.Hook, revision string) string {
+	prefix := ac.Name + "-" + hook.Name
+	if len(prefix) > maxNameLength-len(revision)-1 {
+		prefix = prefix[:maxNameLength-len(revision)-1]
+	}
+	return prefix + "-" + revision
+}
+
+func getHookStatus(name string, phase appv1.HookPhase, statuses []appv1.HookStatus) (appv1.HookStatus, bool) {
+	for _, hs := range statuses {
+		if hs.Name == name && hs.Phase == phase {
+			return hs, true
+		}
+	}
+	return appv1.HookStatus{}, false
+}
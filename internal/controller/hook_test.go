@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func newHookTestReconciler(t *testing.T, objs ...client.Object) *AppConfigReconciler {
+	t.Helper()
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).WithStatusSubresource(&appv1.AppConfig{})
+	for _, obj := range []client.Object{&batchv1.Job{}, &corev1.ConfigMap{}} {
+		c = c.WithIndex(obj, ownerKey, func(obj client.Object) []string {
+			if owner := metav1.GetControllerOf(obj); owner != nil {
+				return []string{owner.Name}
+			}
+			return nil
+		})
+	}
+	return &AppConfigReconciler{Client: c.Build(), Scheme: s, Recorder: record.NewFakeRecorder(10)}
+}
+
+func TestRunHooksJobPod(t *testing.T) {
+	ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+	appv1.AddAnnotation(ac, appv1.DeploymentConfigAnnotation, `{"spec":{"template":{"spec":{"serviceAccountName":"demo","imagePullSecrets":[{"name":"regcred"}]}}}}`)
+	appv1.AddAnnotation(ac, appv1.ContainersInjectionAnnotation, `[{"name":"proxy","image":"proxy:v1"}]`)
+	appv1.AddAnnotation(ac, appv1.SidecarProfileAnnotation, "mesh")
+	ac.Spec.Env = []corev1.EnvVar{{Name: "MODE", Value: "prod"}, {Name: "DB", Value: "main"}}
+	ac.Spec.DeployConfigs = []appv1.DeployConfig{{
+		Name:  "demo",
+		Type:  appv1.StableDeploy,
+		Image: "app:v1",
+		ConfigFiles: &appv1.ConfigFiles{
+			MountPath: "/etc/app",
+			Files:     map[string]string{"app.yaml": "debug: false"},
+		},
+	}}
+	ac.Spec.Hooks = []appv1.Hook{{
+		Name:  "migrate",
+		Phase: appv1.PreHook,
+		Container: corev1.Container{
+			Command: []string{"migrate"},
+			Env:     []corev1.EnvVar{{Name: "DB", Value: "migration"}},
+		},
+	}}
+	r := newHookTestReconciler(t, ac)
+	ctx := context.Background()
+
+	done, err := r.runHooks(ctx, ac, appv1.PreHook, "app:v2")
+	if err != nil || done {
+		t.Fatalf("runHooks() = %v, %v, want running", done, err)
+	}
+	job := &batchv1.Job{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: getHookJobName(ac, &ac.Spec.Hooks[0], getRevision("app:v2"))}, job); err != nil {
+		t.Fatal(err)
+	}
+	spec := job.Spec.Template.Spec
+	if spec.ServiceAccountName != "demo" || len(spec.ImagePullSecrets) != 1 || spec.ImagePullSecrets[0].Name != "regcred" {
+		t.Errorf("serviceAccount = %q, imagePullSecrets = %v", spec.ServiceAccountName, spec.ImagePullSecrets)
+	}
+	if spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("restartPolicy = %s, want Never", spec.RestartPolicy)
+	}
+	if len(spec.Volumes) != 1 || spec.Volumes[0].Name != configFilesVolume {
+		t.Errorf("volumes = %v, want config files volume", spec.Volumes)
+	}
+	if len(spec.Containers) != 1 {
+		t.Fatalf("containers = %v, want hook container", spec.Containers)
+	}
+	container := spec.Containers[0]
+	if container.Name != appv1.HookLabel || container.Image != "app:v2" || len(container.Command) != 1 || container.Command[0] != "migrate" {
+		t.Errorf("container = %s %s %v", container.Name, container.Image, container.Command)
+	}
+	env := make(map[string]string)
+	for _, e := range container.Env {
+		env[e.Name] = e.Value
+	}
+	if env["MODE"] != "prod" || env["DB"] != "migration" {
+		t.Errorf("env = %v, want app env overridden by hook env", container.Env)
+	}
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != "/etc/app" {
+		t.Errorf("volumeMounts = %v", container.VolumeMounts)
+	}
+	if job.Spec.Template.Labels[appName] != "" {
+		t.Errorf("hook pod should not be selected by the service: %v", job.Spec.Template.Labels)
+	}
+	if got := appv1.GetLabel(&job.Spec.Template, appv1.InjectionLabel); got != appv1.DisabledValue {
+		t.Errorf("injection label = %q, want %s", got, appv1.DisabledValue)
+	}
+	for _, k := range []string{appv1.ContainersInjectionAnnotation, appv1.SidecarProfileAnnotation} {
+		if v := appv1.GetAnnotation(&job.Spec.Template, k); v != appv1.NilValue {
+			t.Errorf("hook pod annotation %s = %q, want removed", k, v)
+		}
+	}
+}
+
+func TestRunHooksFailed(t *testing.T) {
+	tests := []struct {
+		name     string
+		phase    appv1.HookPhase
+		wantDone bool
+		wantErr  bool
+	}{
+		{name: "pre hook blocks stable", phase: appv1.PreHook, wantErr: true},
+		{name: "post hook finished", phase: appv1.PostHook, wantDone: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+			ac.Spec.DeployConfigs = []appv1.DeployConfig{{Name: "demo", Type: appv1.StableDeploy, Image: "app:v1"}}
+			ac.Spec.Hooks = []appv1.Hook{{Name: "smoke", Phase: tt.phase, Container: corev1.Container{Command: []string{"smoke"}}}}
+			job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+				Name:      getHookJobName(ac, &ac.Spec.Hooks[0], getRevision("app:v1")),
+				Namespace: "default",
+			}}
+			job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+			r := newHookTestReconciler(t, ac)
+			if err := ctrl.SetControllerReference(ac, job, r.Scheme); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Create(context.Background(), job); err != nil {
+				t.Fatal(err)
+			}
+			recorder := r.Recorder.(*record.FakeRecorder)
+
+			for i := 0; i < 2; i++ {
+				done, err := r.runHooks(context.Background(), ac, tt.phase, "app:v1")
+				if (err != nil) != tt.wantErr || done != tt.wantDone {
+					t.Fatalf("runHooks() = %v, %v, want %v, wantErr %v", done, err, tt.wantDone, tt.wantErr)
+				}
+				if reason, _ := permanentReason(err); tt.wantErr && reason != appv1.HookFailedReason {
+					t.Errorf("reason = %s, want %s", reason, appv1.HookFailedReason)
+				}
+				if len(ac.Status.Hooks) != 1 || ac.Status.Hooks[0].Result != appv1.HookFailed {
+					t.Errorf("hook status = %+v, want failed", ac.Status.Hooks)
+				}
+			}
+			// 失败事件只记录一次
+			if n := len(recorder.Events); n != 1 {
+				t.Errorf("got %d events, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"net/http"
+	"net/http/httptest"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sanmuyan.com/app-operator/internal/registry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchImagesWithCredential(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// 私有仓库，token 服务只接受 alice:secret
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.Header.Get("Authorization") != basic {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token":"private-token"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer private-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v2/team/app/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"name":"team/app","tags":["v1.0.0","v1.1.0","v2.0.0"]}`))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	newSecret := func(password string) *corev1.Secret {
+		config := `{"auths":{"` + host + `":{"username":"alice","password":"` + password + `"}}}`
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "regcred", Namespace: "default"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(config)},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		secret     *corev1.Secret
+		wantImage  string
+		wantReason string
+	}{
+		{name: "pull secret", secret: newSecret("secret"), wantImage: host + "/team/app:v1.1.0"},
+		{name: "wrong password", secret: newSecret("wrong"), wantImage: host + "/team/app:v1.0.0", wantReason: appv1.RegistryUnauthorizedReason},
+		{name: "missing pull secret", wantImage: host + "/team/app:v1.0.0", wantReason: appv1.RegistryUnauthorizedReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+			appv1.AddAnnotation(ac, appv1.DeploymentConfigAnnotation, `{"spec":{"template":{"spec":{"imagePullSecrets":[{"name":"regcred"}]}}}}`)
+			ac.Spec.DeployConfigs = []appv1.DeployConfig{{
+				Name:       "demo-canary",
+				Type:       appv1.CanaryDeploy,
+				Image:      host + "/team/app:v1.0.0",
+				ImageWatch: &appv1.ImageWatch{SemverRange: "<2.0.0"},
+			}}
+			objs := []client.Object{ac}
+			if tt.secret != nil {
+				objs = append(objs, tt.secret)
+			}
+			r := &AppConfigReconciler{
+				Client:   fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).WithStatusSubresource(&appv1.AppConfig{}).Build(),
+				Scheme:   s,
+				Recorder: record.NewFakeRecorder(10),
+				Registry: registry.NewClient(nil),
+			}
+
+			_, err := r.watchImages(context.Background(), ac)
+			reason, _ := permanentReason(err)
+			if tt.wantReason == "" && err != nil {
+				t.Fatalf("watchImages() error = %v", err)
+			}
+			if reason != tt.wantReason {
+				t.Fatalf("watchImages() error = %v, want reason %q", err, tt.wantReason)
+			}
+			got := &appv1.AppConfig{}
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(ac), got); err != nil {
+				t.Fatal(err)
+			}
+			if image := got.Spec.DeployConfigs[0].Image; image != tt.wantImage {
+				t.Errorf("image = %s, want %s", image, tt.wantImage)
+			}
+		})
+	}
+}
+
+func TestWatchImagesPolicyAndFreeze(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		_, _ = w.Write([]byte(`{"name":"team/app","tags":["v1.0.0","v1.1.0","v1.2.0"]}`))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	policy := &appv1.AppPolicy{ObjectMeta: metav1.ObjectMeta{Name: "deny", Namespace: "default"}}
+	policy.Spec.ImagePolicy = &appv1.ImagePolicy{DeniedTags: []string{"v1.2.0"}}
+	start := metav1.NewTime(time.Now().Add(-time.Hour))
+	end := metav1.NewTime(time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name      string
+		paused    bool
+		freeze    bool
+		wantImage string
+		wantPolls int
+	}{
+		{name: "denied tag skipped", wantImage: host + "/team/app:v1.1.0", wantPolls: 1},
+		{name: "paused", paused: true, wantImage: host + "/team/app:v1.0.0"},
+		{name: "frozen", freeze: true, wantImage: host + "/team/app:v1.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polls = 0
+			ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+			ac.Spec.Paused = tt.paused
+			if tt.freeze {
+				ac.Spec.FreezeWindows = []appv1.FreezeWindow{{Start: &start, End: &end}}
+			}
+			ac.Spec.DeployConfigs = []appv1.DeployConfig{{
+				Name:       "demo-canary",
+				Type:       appv1.CanaryDeploy,
+				Image:      host + "/team/app:v1.0.0",
+				ImageWatch: &appv1.ImageWatch{SemverRange: "<2.0.0"},
+			}}
+			r := &AppConfigReconciler{
+				Client:   fake.NewClientBuilder().WithScheme(s).WithObjects(ac, policy).WithStatusSubresource(&appv1.AppConfig{}).Build(),
+				Scheme:   s,
+				Recorder: record.NewFakeRecorder(10),
+				Registry: registry.NewClient([]string{host}),
+			}
+
+			next, err := r.watchImages(context.Background(), ac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if polls != tt.wantPolls {
+				t.Errorf("polls = %d, want %d", polls, tt.wantPolls)
+			}
+			// 冻结时到窗口结束后重新调谐
+			if tt.freeze && (next < time.Hour-time.Minute || next > time.Hour+time.Second) {
+				t.Errorf("requeue after = %s, want about 1h", next)
+			}
+			got := &appv1.AppConfig{}
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(ac), got); err != nil {
+				t.Fatal(err)
+			}
+			if image := got.Spec.DeployConfigs[0].Image; image != tt.wantImage {
+				t.Errorf("image = %s, want %s", image, tt.wantImage)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"errors"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"testing"
+	"time"
+)
+
+func TestSetIngressCanaryWeight(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	r := &AppConfigReconciler{Scheme: s}
+
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		canaryReady   int32
+		totalReady    int32
+		currentWeight string
+		wantCanary    string
+		wantWeight    string
+		wantErr       bool
+	}{
+		{
+			name:       "canary ingress disabled",
+			wantCanary: appv1.FalseValue,
+			wantWeight: "0",
+		},
+		{
+			name:        "rolling weight disabled",
+			annotations: map[string]string{appv1.CanaryIngressAnnotation: appv1.TureValue},
+			canaryReady: 1,
+			totalReady:  2,
+		},
+		{
+			name: "ready ratio",
+			annotations: map[string]string{
+				appv1.CanaryIngressAnnotation:       appv1.TureValue,
+				appv1.CanaryRollingWeightAnnotation: appv1.TureValue,
+			},
+			canaryReady: 1,
+			totalReady:  4,
+			wantCanary:  appv1.TureValue,
+			wantWeight:  "25",
+		},
+		{
+			name: "no available replicas",
+			annotations: map[string]string{
+				appv1.CanaryIngressAnnotation:          appv1.TureValue,
+				appv1.CanaryRollingWeightAnnotation:    appv1.TureValue,
+				appv1.CanaryRollingMinWeightAnnotation: "5",
+			},
+			wantCanary: appv1.TureValue,
+			wantWeight: "5",
+		},
+		{
+			name: "max weight",
+			annotations: map[string]string{
+				appv1.CanaryIngressAnnotation:          appv1.TureValue,
+				appv1.CanaryRollingWeightAnnotation:    appv1.TureValue,
+				appv1.CanaryRollingMaxWeightAnnotation: "30",
+			},
+			canaryReady: 3,
+			totalReady:  4,
+			wantCanary:  appv1.TureValue,
+			wantWeight:  "30",
+		},
+		{
+			name: "smoothing up from current weight",
+			annotations: map[string]string{
+				appv1.CanaryIngressAnnotation:           appv1.TureValue,
+				appv1.CanaryRollingWeightAnnotation:     appv1.TureValue,
+				appv1.CanaryRollingWeightStepAnnotation: "10",
+			},
+			canaryReady:   1,
+			totalReady:    2,
+			currentWeight: "20",
+			wantCanary:    appv1.TureValue,
+			wantWeight:    "30",
+		},
+		{
+			name: "smoothing down from current weight",
+			annotations: map[string]string{
+				appv1.CanaryIngressAnnotation:           appv1.TureValue,
+				appv1.CanaryRollingWeightAnnotation:     appv1.TureValue,
+				appv1.CanaryRollingWeightStepAnnotation: "10",
+			},
+			canaryReady:   0,
+			totalReady:    2,
+			currentWeight: "50",
+			wantCanary:    appv1.TureValue,
+			wantWeight:    "40",
+		},
+		{
+			name: "invalid min max",
+			annotations: map[string]string{
+				appv1.CanaryIngressAnnotation:          appv1.TureValue,
+				appv1.CanaryRollingWeightAnnotation:    appv1.TureValue,
+				appv1.CanaryRollingMinWeightAnnotation: "60",
+				appv1.CanaryRollingMaxWeightAnnotation: "40",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid step",
+			annotations: map[string]string{
+				appv1.CanaryIngressAnnotation:           appv1.TureValue,
+				appv1.CanaryRollingWeightAnnotation:     appv1.TureValue,
+				appv1.CanaryRollingWeightStepAnnotation: "fast",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "uid"}}
+			for k, v := range tt.annotations {
+				appv1.AddAnnotation(ac, k, v)
+			}
+			ac.Spec.Service.Port = 8080
+			ac.Status.AvailableReplicas = tt.totalReady
+			ac.Status.DeployStatus = []appv1.DeployStatus{
+				{Type: appv1.StableDeploy, AvailableReplicas: tt.totalReady - tt.canaryReady},
+				{Type: appv1.CanaryDeploy, AvailableReplicas: tt.canaryReady},
+			}
+			dc := &appv1.DeployConfig{Name: "demo-canary", Type: appv1.CanaryDeploy}
+
+			ingress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: dc.Name, Namespace: ac.Namespace}}
+			if tt.currentWeight != "" {
+				appv1.AddOtherAnnotation(ingress, appv1.NginxIngressWeightAnnotation, tt.currentWeight)
+			}
+			pending := false
+			err := r.setIngress(ingress, ac, dc, &pending)()
+			if tt.wantErr {
+				var pe *permanentError
+				if !errors.As(err, &pe) || pe.reason != appv1.InvalidConfigReason {
+					t.Fatalf("got error %v, want permanent %s error", err, appv1.InvalidConfigReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ingress.Annotations[appv1.NginxIngressCanaryAnnotation]; got != tt.wantCanary {
+				t.Errorf("canary = %q, want %q", got, tt.wantCanary)
+			}
+			if got := ingress.Annotations[appv1.NginxIngressWeightAnnotation]; got != tt.wantWeight {
+				t.Errorf("canary-weight = %q, want %q", got, tt.wantWeight)
+			}
+		})
+	}
+}
+
+func TestSetIngressCanaryWeightInterval(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	r := &AppConfigReconciler{Scheme: s}
+	ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "uid"}}
+	appv1.AddAnnotation(ac, appv1.CanaryIngressAnnotation, appv1.TureValue)
+	appv1.AddAnnotation(ac, appv1.CanaryRollingWeightAnnotation, appv1.TureValue)
+	appv1.AddAnnotation(ac, appv1.CanaryRollingWeightStepAnnotation, "10")
+	ac.Status.AvailableReplicas = 2
+	ac.Status.DeployStatus = []appv1.DeployStatus{
+		{Type: appv1.StableDeploy, AvailableReplicas: 1},
+		{Type: appv1.CanaryDeploy, AvailableReplicas: 1},
+	}
+	dc := &appv1.DeployConfig{Name: "demo-canary", Type: appv1.CanaryDeploy}
+	ingress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: dc.Name, Namespace: ac.Namespace}}
+
+	// ingress 更新后立即触发的调谐不会再次变化权重
+	for i := 0; i < 2; i++ {
+		pending := false
+		if err := r.setIngress(ingress, ac, dc, &pending)(); err != nil {
+			t.Fatal(err)
+		}
+		if got := ingress.Annotations[appv1.NginxIngressWeightAnnotation]; got != "10" {
+			t.Errorf("reconcile %d: canary-weight = %q, want 10", i, got)
+		}
+		if !pending {
+			t.Errorf("reconcile %d: weight should be pending", i)
+		}
+	}
+
+	// 超过间隔后继续变化
+	appv1.AddAnnotation(ingress, appv1.CanaryWeightUpdatedAnnotation, time.Now().Add(-canaryWeightStepInterval).UTC().Format(time.RFC3339))
+	pending := false
+	if err := r.setIngress(ingress, ac, dc, &pending)(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ingress.Annotations[appv1.NginxIngressWeightAnnotation]; got != "20" {
+		t.Errorf("canary-weight = %q, want 20", got)
+	}
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// updateMirror 根据 provider 更新流量复制配置并记录状态，nginx 的注解在 setIngress 中设置
+func (r *AppConfigReconciler) updateMirror(ctx context.Context, ac *appv1.AppConfig) error {
+	status := ac.Status.DeepCopy()
+	status.Mirror = nil
+	m := ac.Spec.Mirror
+	if m != nil {
+		status.Mirror = &appv1.MirrorStatus{
+			Provider: m.GetProvider(),
+			Active:   isMirrorActive(ac),
+			Percent:  m.GetPercent(),
+		}
+		if canary, ok := ac.GetDeployConfig(appv1.CanaryDeploy); ok {
+			status.Mirror.Target = canary.Name
+		}
+	}
+
+	// 只在开启流量复制时管理 HTTPRoute，关闭后删除
+	if m != nil && m.Enable && m.GetProvider() == appv1.GatewayMirror {
+		// canary-ingress 可能由 AppPolicy 设置，webhook 无法拦截
+		if appv1.GetAnnotation(ac, appv1.CanaryIngressAnnotation) == appv1.TureValue {
+			return newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("weighted canary traffic is not supported by the gateway mirror provider"))
+		}
+		route := newHTTPRoute()
+		route.SetNamespace(ac.Namespace)
+		route.SetName(ac.Name)
+		res, err := controllerutil.CreateOrUpdate(ctx, r.Client, route, r.setHTTPRoute(route, ac))
+		if meta.IsNoMatchError(err) {
+			return newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("gateway mirror requires the Gateway API HTTPRoute CRD: %w", err))
+		}
+		if err != nil {
+			return err
+		}
+		acLog.V(1).Info("httproute updated", "namespace", ac.Namespace, "name", route.GetName(), "result", res)
+		status.Mirror.HTTPRoute = route.GetName()
+	} else if ac.Status.Mirror != nil && ac.Status.Mirror.HTTPRoute != appv1.NilValue {
+		// 关闭流量复制或不再使用 gateway 时删除之前创建的 HTTPRoute
+		route := newHTTPRoute()
+		route.SetNamespace(ac.Namespace)
+		route.SetName(ac.Status.Mirror.HTTPRoute)
+		acLog.Info("delete httproute", "namespace", ac.Namespace, "name", route.GetName())
+		if err := r.Delete(ctx, route); client.IgnoreNotFound(err) != nil && !meta.IsNoMatchError(err) {
+			return err
+		}
+	}
+	return r.patchStatus(ctx, ac, *status)
+}
+
+// setHTTPRoute 把 host 的流量路由到 stable service，开启流量复制时添加 RequestMirror 过滤器
+func (r *AppConfigReconciler) setHTTPRoute(route *unstructured.Unstructured, ac *appv1.AppConfig) controllerutil.MutateFn {
+	return func() error {
+		m := ac.Spec.Mirror
+		stable, ok := ac.GetDeployConfig(appv1.StableDeploy)
+		if !ok {
+			return newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("gateway mirror requires a stable deployConfig"))
+		}
+		port := int64(ac.Spec.Service.Port)
+		rule := map[string]interface{}{
+			"backendRefs": []interface{}{
+				map[string]interface{}{"name": stable.Name, "port": port},
+			},
+		}
+		if canary, ok := ac.GetDeployConfig(appv1.CanaryDeploy); ok && isMirrorActive(ac) {
+			rule["filters"] = []interface{}{
+				map[string]interface{}{
+					"type": "RequestMirror",
+					"requestMirror": map[string]interface{}{
+						"backendRef": map[string]interface{}{"name": canary.Name, "port": port},
+						"percent":    int64(m.GetPercent()),
+					},
+				},
+			}
+		}
+		parentRef := map[string]interface{}{"name": m.GatewayName}
+		if m.GatewayNamespace != appv1.NilValue {
+			parentRef["namespace"] = m.GatewayNamespace
+		}
+		spec := map[string]interface{}{
+			"parentRefs": []interface{}{parentRef},
+			"rules":      []interface{}{rule},
+		}
+		if ac.Spec.Ingress.Host != appv1.NilValue {
+			spec["hostnames"] = []interface{}{ac.Spec.Ingress.Host}
+		}
+		route.Object["spec"] = spec
+
+		route.SetLabels(map[string]string{appv1.CreatedByLabel: appv1.OperatorName})
+		return ctrl.SetControllerReference(ac, route, r.Scheme)
+	}
+}
+
+// isMirrorActive 开启流量复制并且 canary 有可用副本时才复制流量
+func isMirrorActive(ac *appv1.AppConfig) bool {
+	if ac.Spec.Mirror == nil || !ac.Spec.Mirror.Enable {
+		return false
+	}
+	canaryStatus, ok := getDeployStatus(appv1.CanaryDeploy, ac.Status.DeployStatus)
+	return ok && canaryStatus.AvailableReplicas > 0
+}
+
+// getMirrorTarget 返回 nginx mirror-target 注解的值
+func getMirrorTarget(ac *appv1.AppConfig, svc string) string {
+	return fmt.Sprintf("http://%s.%s.svc.cluster.local:%d$request_uri", svc, ac.Namespace, ac.Spec.Service.Port)
+}
+
+func newHTTPRoute() *unstructured.Unstructured {
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(httpRouteGVK)
+	return route
+}
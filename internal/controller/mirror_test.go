@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestUpdateMirrorGateway(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	newAppConfig := func(provider appv1.MirrorProvider) *appv1.AppConfig {
+		ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+		ac.Spec.DeployConfigs = []appv1.DeployConfig{
+			{Name: "demo-stable", Type: appv1.StableDeploy, Image: "app:v1"},
+			{Name: "demo-canary", Type: appv1.CanaryDeploy, Image: "app:v2"},
+		}
+		ac.Spec.Service.Port = 8080
+		ac.Spec.Ingress.Host = "demo.example.com"
+		percent := int32(20)
+		ac.Spec.Mirror = &appv1.TrafficMirror{Enable: true, Provider: provider, GatewayName: "gw", Percent: &percent}
+		ac.Status.DeployStatus = []appv1.DeployStatus{
+			{Type: appv1.StableDeploy, AvailableReplicas: 1},
+			{Type: appv1.CanaryDeploy, AvailableReplicas: 1},
+		}
+		return ac
+	}
+	weighted := newAppConfig(appv1.GatewayMirror)
+	appv1.AddAnnotation(weighted, appv1.CanaryIngressAnnotation, appv1.TureValue)
+	switched := newAppConfig(appv1.NginxMirror)
+	switched.Status.Mirror = &appv1.MirrorStatus{Provider: appv1.GatewayMirror, HTTPRoute: "demo"}
+	disabled := newAppConfig(appv1.GatewayMirror)
+	disabled.Spec.Mirror.Enable = false
+	disabled.Status.Mirror = &appv1.MirrorStatus{Provider: appv1.GatewayMirror, HTTPRoute: "demo"}
+	existing := newHTTPRoute()
+	existing.SetNamespace("default")
+	existing.SetName("demo")
+
+	tests := []struct {
+		name       string
+		ac         *appv1.AppConfig
+		objs       []client.Object
+		wantRoute  bool
+		wantReason string
+	}{
+		{name: "mirror to canary", ac: newAppConfig(appv1.GatewayMirror), wantRoute: true},
+		{name: "weighted canary", ac: weighted, wantReason: appv1.InvalidConfigReason},
+		{name: "switch to nginx", ac: switched, objs: []client.Object{existing}},
+		{name: "mirror disabled", ac: disabled, objs: []client.Object{existing}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithScheme(s).WithObjects(tt.ac).WithObjects(tt.objs...).WithStatusSubresource(&appv1.AppConfig{}).Build()
+			r := &AppConfigReconciler{Client: c, Scheme: s, Recorder: record.NewFakeRecorder(10)}
+			ctx := context.Background()
+			err := r.updateMirror(ctx, tt.ac)
+			if tt.wantReason != "" {
+				var pe *permanentError
+				if !errors.As(err, &pe) || pe.reason != tt.wantReason {
+					t.Fatalf("updateMirror() error = %v, want reason %s", err, tt.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			route := newHTTPRoute()
+			err = c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "demo"}, route)
+			if !tt.wantRoute {
+				if !apierrors.IsNotFound(err) {
+					t.Fatalf("httproute should be deleted, got error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+			if len(rules) != 1 {
+				t.Fatalf("rules = %v, want 1 rule", rules)
+			}
+			rule := rules[0].(map[string]interface{})
+			backendRefs, _, _ := unstructured.NestedSlice(rule, "backendRefs")
+			if len(backendRefs) != 1 || backendRefs[0].(map[string]interface{})["name"] != "demo-stable" {
+				t.Errorf("backendRefs = %v, want stable only", backendRefs)
+			}
+			filters, _, _ := unstructured.NestedSlice(rule, "filters")
+			if len(filters) != 1 {
+				t.Fatalf("filters = %v, want RequestMirror", filters)
+			}
+			target, _, _ := unstructured.NestedString(filters[0].(map[string]interface{}), "requestMirror", "backendRef", "name")
+			percent, _, _ := unstructured.NestedInt64(filters[0].(map[string]interface{}), "requestMirror", "percent")
+			if target != "demo-canary" || percent != 20 {
+				t.Errorf("mirror target = %s, percent = %d, want demo-canary 20", target, percent)
+			}
+			if tt.ac.Status.Mirror == nil || tt.ac.Status.Mirror.HTTPRoute != "demo" || !tt.ac.Status.Mirror.Active {
+				t.Errorf("mirror status = %+v", tt.ac.Status.Mirror)
+			}
+		})
+	}
+}
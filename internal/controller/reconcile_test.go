@@ -0,0 +1,225 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"strings"
+	"testing"
+)
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPatchStatus(t *testing.T) {
+	s := newTestScheme(t)
+	gr := schema.GroupResource{Group: appv1.GroupVersion.Group, Resource: "appconfigs"}
+	conflict := apierrors.NewConflict(gr, "demo", errors.New("the object has been modified"))
+	invalid := apierrors.NewInvalid(appv1.GroupVersion.WithKind(apiKind).GroupKind(), "demo", field.ErrorList{field.Invalid(field.NewPath("status"), nil, "invalid")})
+
+	tests := []struct {
+		name        string
+		unchanged   bool
+		failures    int
+		failWith    error
+		wantPatches int
+		wantErr     func(error) bool
+	}{
+		{name: "unchanged", unchanged: true},
+		{name: "patched", wantPatches: 1},
+		{name: "retry on conflict", failures: 2, failWith: conflict, wantPatches: 3},
+		{name: "conflict exhausted", failures: 100, failWith: conflict, wantPatches: 5, wantErr: apierrors.IsConflict},
+		{name: "invalid not retried", failures: 100, failWith: invalid, wantPatches: 1, wantErr: apierrors.IsInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+			ac.Status.AvailableReplicas = 1
+			patches := 0
+			c := fake.NewClientBuilder().WithScheme(s).WithObjects(ac.DeepCopy()).WithStatusSubresource(&appv1.AppConfig{}).
+				WithInterceptorFuncs(interceptor.Funcs{
+					SubResourcePatch: func(ctx context.Context, c client.Client, sub string, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+						patches++
+						if patches <= tt.failures {
+							return tt.failWith
+						}
+						return c.SubResource(sub).Patch(ctx, obj, patch, opts...)
+					},
+				}).Build()
+			r := &AppConfigReconciler{Client: c, Scheme: s}
+
+			status := ac.Status.DeepCopy()
+			if !tt.unchanged {
+				status.AvailableReplicas = 2
+			}
+			err := r.patchStatus(context.Background(), ac, *status)
+			if patches != tt.wantPatches {
+				t.Errorf("patches = %d, want %d", patches, tt.wantPatches)
+			}
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("patchStatus() error = %v", err)
+				}
+				if ac.Status.AvailableReplicas != 1 {
+					t.Error("in-memory status changed after failed patch")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &appv1.AppConfig{}
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(ac), got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status.AvailableReplicas != status.AvailableReplicas || ac.Status.AvailableReplicas != status.AvailableReplicas {
+				t.Errorf("availableReplicas = %d/%d, want %d", got.Status.AvailableReplicas, ac.Status.AvailableReplicas, status.AvailableReplicas)
+			}
+		})
+	}
+}
+
+func TestHandleError(t *testing.T) {
+	s := newTestScheme(t)
+	gk := appv1.GroupVersion.WithKind(apiKind).GroupKind()
+	gr := schema.GroupResource{Group: appv1.GroupVersion.Group, Resource: "appconfigs"}
+	deleteProtected := apierrors.NewInvalid(gk, "demo", field.ErrorList{field.Forbidden(field.NewPath(appv1.ProtectedFieldPath), "delete protected")})
+
+	tests := []struct {
+		name       string
+		err        error
+		wantErr    bool
+		wantReason string
+	}{
+		{name: "not found", err: apierrors.NewNotFound(gr, "demo")},
+		{name: "conflict", err: apierrors.NewConflict(gr, "demo", errors.New("modified")), wantErr: true},
+		{name: "transient", err: errors.New("connection refused"), wantErr: true},
+		{name: "invalid", err: apierrors.NewInvalid(gk, "demo", field.ErrorList{field.Invalid(field.NewPath("spec"), nil, "invalid")}), wantReason: appv1.InvalidConfigReason},
+		{name: "bad request", err: apierrors.NewBadRequest("bad request"), wantReason: appv1.InvalidConfigReason},
+		{name: "delete protected", err: fmt.Errorf("delete deployment: %w", deleteProtected), wantReason: appv1.DeleteProtectedReason},
+		{name: "permanent", err: newPermanentError(appv1.HookFailedReason, errors.New("hook failed")), wantReason: appv1.HookFailedReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+			recorder := record.NewFakeRecorder(10)
+			r := &AppConfigReconciler{
+				Client:   fake.NewClientBuilder().WithScheme(s).WithObjects(ac.DeepCopy()).WithStatusSubresource(&appv1.AppConfig{}).Build(),
+				Scheme:   s,
+				Recorder: recorder,
+			}
+
+			result, err := r.handleError(context.Background(), ac, tt.err)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handleError() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result.Requeue || result.RequeueAfter != 0 {
+				t.Errorf("handleError() result = %+v, want no requeue", result)
+			}
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			cond := meta.FindStatusCondition(ac.Status.Conditions, appv1.ReadyCondition)
+			if tt.wantReason == "" {
+				if event != "" || cond != nil {
+					t.Errorf("event = %q, condition = %v, want none", event, cond)
+				}
+				return
+			}
+			if !strings.HasPrefix(event, corev1.EventTypeWarning+" "+tt.wantReason+" ") {
+				t.Errorf("event = %q, want reason %s", event, tt.wantReason)
+			}
+			if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != tt.wantReason {
+				t.Errorf("ready condition = %v, want False/%s", cond, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestReconcileRequeueWhileProgressing(t *testing.T) {
+	s := newTestScheme(t)
+	ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{
+		Name:       "demo",
+		Namespace:  "default",
+		Finalizers: []string{appv1.AppConfigFinalizer},
+	}}
+	ac.Spec.DeployConfigs = []appv1.DeployConfig{{Name: "demo", Type: appv1.StableDeploy, Image: "app:v1"}}
+
+	c := fake.NewClientBuilder().WithScheme(s).WithObjects(ac).WithStatusSubresource(&appv1.AppConfig{})
+	for _, obj := range []client.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}, &batchv1.Job{}, &batchv1.CronJob{}, &corev1.ConfigMap{}} {
+		c = c.WithIndex(obj, ownerKey, func(obj client.Object) []string {
+			if owner := metav1.GetControllerOf(obj); owner != nil {
+				return []string{owner.Name}
+			}
+			return nil
+		})
+	}
+	r := &AppConfigReconciler{Client: c.Build(), Scheme: s, Recorder: record.NewFakeRecorder(10)}
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ac)}
+	ready := func() *metav1.Condition {
+		got := &appv1.AppConfig{}
+		if err := r.Get(ctx, req.NamespacedName, got); err != nil {
+			t.Fatal(err)
+		}
+		return meta.FindStatusCondition(got.Status.Conditions, appv1.ReadyCondition)
+	}
+
+	// 新建的 Deployment 还没有可用副本
+	result, err := r.Reconcile(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter != rolloutRequeueAfter {
+		t.Errorf("requeueAfter = %s, want %s", result.RequeueAfter, rolloutRequeueAfter)
+	}
+	if cond := ready(); cond == nil || cond.Reason != appv1.ProgressingReason {
+		t.Errorf("ready condition = %v, want %s", cond, appv1.ProgressingReason)
+	}
+
+	// 发布完成后不再定时重新调谐
+	dm := &appsv1.Deployment{}
+	if err := r.Get(ctx, req.NamespacedName, dm); err != nil {
+		t.Fatal(err)
+	}
+	dm.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	if err := r.Status().Update(ctx, dm); err != nil {
+		t.Fatal(err)
+	}
+	result, err = r.Reconcile(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter != 0 {
+		t.Errorf("requeueAfter = %s, want 0", result.RequeueAfter)
+	}
+	if cond := ready(); cond == nil || cond.Reason != appv1.ReconciledReason {
+		t.Errorf("ready condition = %v, want %s", cond, appv1.ReconciledReason)
+	}
+}
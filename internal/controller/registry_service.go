@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sanmuyan.com/app-operator/internal/registry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// getImagePullSecrets 返回 deployConfig 渲染后的 Pod 使用的 imagePullSecrets，来自全局模板和 deployment-config 注解
+func (r *AppConfigReconciler) getImagePullSecrets(ac *appv1.AppConfig, dc *appv1.DeployConfig) ([]corev1.LocalObjectReference, error) {
+	wl := newWorkload(dc.GetWorkloadKind())
+	key := "deployment"
+	if dc.GetWorkloadKind() == appv1.StatefulSetWorkload {
+		key = "statefulset"
+	}
+	if tmpl, ok := getTemplate(key); ok {
+		if err := yaml.Unmarshal([]byte(tmpl), wl); err != nil {
+			acLog.Info("failed to unmarshal "+key+" template", "namespace", ac.Namespace, "name", dc.Name, "error", err)
+		}
+	}
+	if err := r.loadDeploymentConfig(wl, ac); err != nil {
+		return nil, err
+	}
+	return getPodTemplate(wl).Spec.ImagePullSecrets, nil
+}
+
+// getRegistryCredential 按顺序查找 imagePullSecrets 中镜像仓库的凭证，和 kubelet 一样跳过不存在的 Secret，没有找到时返回 nil
+func (r *AppConfigReconciler) getRegistryCredential(ctx context.Context, ac *appv1.AppConfig, dc *appv1.DeployConfig, ref appv1.ImageRef) (*registry.Credential, error) {
+	pullSecrets, err := r.getImagePullSecrets(ac, dc)
+	if err != nil {
+		return nil, err
+	}
+	for _, ps := range pullSecrets {
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: ac.Namespace, Name: ps.Name}, secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		var data []byte
+		switch secret.Type {
+		case corev1.SecretTypeDockerConfigJson:
+			data = secret.Data[corev1.DockerConfigJsonKey]
+		case corev1.SecretTypeDockercfg:
+			data = secret.Data[corev1.DockerConfigKey]
+		default:
+			continue
+		}
+		cred, err := registry.FindCredential(data, ref.Registry)
+		if err != nil {
+			return nil, newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("invalid imagePullSecret %s: %w", ps.Name, err))
+		}
+		if cred != nil {
+			return cred, nil
+		}
+	}
+	return nil, nil
+}
+
+// registryError 镜像或凭证错误重试不会恢复，作为永久错误处理
+func registryError(err error) error {
+	switch {
+	case errors.Is(err, registry.ErrNotFound):
+		return newPermanentError(appv1.InvalidConfigReason, err)
+	case errors.Is(err, registry.ErrUnauthorized):
+		return newPermanentError(appv1.RegistryUnauthorizedReason, err)
+	}
+	return err
+}
@@ -2,22 +2,45 @@ package controller
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"os"
 	appv1 "sanmuyan.com/app-operator/api/v1"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	acLog      = log.Log.WithName("appconfig-controller")
-	ownerKey   = ".metadata.controller"
-	apiGVStr   = appv1.GroupVersion.String()
-	templateCM = &corev1.ConfigMap{
-		Data: make(map[string]string),
-	}
+	acLog    = log.Log.WithName("appconfig-controller")
+	ownerKey = ".metadata.controller"
+	// configRefKey AppConfig 引用的 ConfigMap/Secret 索引
+	configRefKey = ".spec.configRefs"
+	apiGVStr     = appv1.GroupVersion.String()
+	// templateCM 全局模板，调谐和 dry-run API 并发读写，使用 atomic.Pointer 保存
+	templateCM   atomic.Pointer[corev1.ConfigMap]
 	templatePath = os.Getenv("TEMPLATE_PATH")
+	// httpRouteGVK Gateway API 不是必需的依赖，使用 unstructured 管理 HTTPRoute
+	httpRouteGVK = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "HTTPRoute"}
 )
 
 const (
 	apiKind = appv1.ApiKind
 	appName = appv1.AppName
+	// maxNameLength 资源名称最大长度
+	maxNameLength = 63
+	// headlessSvcSuffix StatefulSet headless service 名称后缀
+	headlessSvcSuffix = "-headless"
+	// configFilesVolume 配置文件在 pod 中的卷名称
+	configFilesVolume = "app-config"
+	// configMapRef secretRef 引用的配置类型
+	configMapRef = "ConfigMap"
+	secretRef    = "Secret"
+	// rolloutRequeueAfter 发布未完成时重新调谐的间隔
+	rolloutRequeueAfter = 10 * time.Second
+	// canaryWeightStepInterval canary 滚动权重两次变化之间的最小间隔，和发布未完成时重新调谐的间隔相同
+	canaryWeightStepInterval = rolloutRequeueAfter
+	// indefiniteFreezeRequeueAfter 冻结窗口无法计算结束时间时重新计算的间隔
+	indefiniteFreezeRequeueAfter = time.Hour
+	// maxActionRecords 状态中保留的手动发布操作记录数量
+	maxActionRecords = 10
 )
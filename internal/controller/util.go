@@ -1,12 +1,19 @@
 package controller
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"math"
 	appv1 "sanmuyan.com/app-operator/api/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"strings"
+	"strconv"
+	"time"
 )
 
 func getDeployStatus(t appv1.DeployType, status []appv1.DeployStatus) (appv1.DeployStatus, bool) {
@@ -18,6 +25,15 @@ func getDeployStatus(t appv1.DeployType, status []appv1.DeployStatus) (appv1.Dep
 	return appv1.DeployStatus{}, false
 }
 
+func getImageWatchStatus(name string, status []appv1.ImageWatchStatus) (appv1.ImageWatchStatus, bool) {
+	for _, s := range status {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return appv1.ImageWatchStatus{}, false
+}
+
 func getCondition(t appsv1.DeploymentConditionType, dcs []appsv1.DeploymentCondition) (appsv1.DeploymentCondition, bool) {
 	for _, s := range dcs {
 		if s.Type == t {
@@ -36,6 +52,50 @@ func getContainer(n string, cs []corev1.Container) (corev1.Container, bool) {
 	return corev1.Container{}, false
 }
 
+func setVolumeMount(name, path string, c *corev1.Container) {
+	for i, vm := range c.VolumeMounts {
+		if vm.Name == name {
+			c.VolumeMounts[i].MountPath = path
+			return
+		}
+	}
+	c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: name, MountPath: path})
+}
+
+// resetContainerConfig 清空 app 容器的健康检查、资源和生命周期，在加载全局模板之前调用，
+// 这些字段由模板、deployment-config 注解和 spec 重新设置，配置中去掉的值不会留在工作负载上
+func resetContainerConfig(cs []corev1.Container) {
+	for i := range cs {
+		if cs[i].Name != appName {
+			continue
+		}
+		cs[i].LivenessProbe = nil
+		cs[i].ReadinessProbe = nil
+		cs[i].StartupProbe = nil
+		cs[i].Resources = corev1.ResourceRequirements{}
+		cs[i].Lifecycle = nil
+	}
+}
+
+// setContainerConfig 设置容器的健康检查、资源和生命周期，没有设置的字段使用模板和注解中的值
+func setContainerConfig(c *corev1.Container, cc appv1.ContainerConfig) {
+	if cc.LivenessProbe != nil {
+		c.LivenessProbe = cc.LivenessProbe.DeepCopy()
+	}
+	if cc.ReadinessProbe != nil {
+		c.ReadinessProbe = cc.ReadinessProbe.DeepCopy()
+	}
+	if cc.StartupProbe != nil {
+		c.StartupProbe = cc.StartupProbe.DeepCopy()
+	}
+	if cc.Resources != nil {
+		c.Resources = *cc.Resources.DeepCopy()
+	}
+	if cc.Lifecycle != nil {
+		c.Lifecycle = cc.Lifecycle.DeepCopy()
+	}
+}
+
 func setContainerImage(n, image string, cs []corev1.Container) {
 	for i, s := range cs {
 		if s.Name == n {
@@ -44,19 +104,231 @@ func setContainerImage(n, image string, cs []corev1.Container) {
 	}
 }
 
-func ignoreError(err error) error {
-	if client.IgnoreNotFound(err) == nil {
-		return nil
+// permanentError 重试无法恢复的错误，需要用户修改配置
+type permanentError struct {
+	reason string
+	err    error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func newPermanentError(reason string, err error) error {
+	return &permanentError{reason: reason, err: err}
+}
+
+// permanentReason 判断是否是永久错误并返回原因
+func permanentReason(err error) (string, bool) {
+	var pe *permanentError
+	if errors.As(err, &pe) {
+		return pe.reason, true
+	}
+	if isDeleteProtected(err) {
+		return appv1.DeleteProtectedReason, true
+	}
+	if apierrors.IsInvalid(err) || apierrors.IsBadRequest(err) {
+		return appv1.InvalidConfigReason, true
+	}
+	return "", false
+}
+
+// sortDeployConfigs 返回 canary 在前 stable 在后的 deployConfig 列表，同类型保持原有顺序
+func sortDeployConfigs(dcs []appv1.DeployConfig) []appv1.DeployConfig {
+	sorted := make([]appv1.DeployConfig, 0, len(dcs))
+	for _, dc := range dcs {
+		if dc.Type == appv1.CanaryDeploy {
+			sorted = append(sorted, dc)
+		}
+	}
+	for _, dc := range dcs {
+		if dc.Type != appv1.CanaryDeploy {
+			sorted = append(sorted, dc)
+		}
+	}
+	return sorted
+}
+
+// isCanaryReleased 判断 canary 是否已经以期望的镜像完成发布并可用
+func isCanaryReleased(ac *appv1.AppConfig, wlMap map[string]client.Object) bool {
+	canary, ok := ac.GetDeployConfig(appv1.CanaryDeploy)
+	if !ok {
+		return false
+	}
+	wl, ok := wlMap[canary.Name]
+	if !ok {
+		return false
+	}
+	appContainer, ok := getContainer(appName, getPodTemplate(wl).Spec.Containers)
+	if !ok || appContainer.Image != canary.Image {
+		return false
+	}
+	if !isRolloutComplete(wl) {
+		return false
+	}
+	return getWorkloadStatus(wl).Available == corev1.ConditionTrue
+}
+
+// isCanaryIdle canary 和 stable 镜像相同并且 stable 发布完成时 canary 进入空闲状态，canary-idle 设置为 false 时关闭
+func isCanaryIdle(ac *appv1.AppConfig, wlMap map[string]client.Object) bool {
+	if appv1.GetAnnotation(ac, appv1.CanaryIdleAnnotation) == appv1.FalseValue {
+		return false
+	}
+	canary, ok := ac.GetDeployConfig(appv1.CanaryDeploy)
+	if !ok {
+		return false
+	}
+	stable, ok := ac.GetDeployConfig(appv1.StableDeploy)
+	if !ok || canary.Image != stable.Image {
+		return false
+	}
+	wl, ok := wlMap[stable.Name]
+	if !ok {
+		return false
+	}
+	appContainer, ok := getContainer(appName, getPodTemplate(wl).Spec.Containers)
+	return ok && appContainer.Image == stable.Image && isRolloutComplete(wl)
+}
+
+// hasPendingImage 判断是否有冻结窗口挂起的镜像
+func hasPendingImage(ac *appv1.AppConfig) bool {
+	if ac.Status.FrozenUntil == nil {
+		return false
+	}
+	for _, ds := range ac.Status.DeployStatus {
+		if ds.PendingImage != appv1.NilValue {
+			return true
+		}
+	}
+	return false
+}
+
+// frozenRequeueAfter 冻结窗口结束后重新调谐，无法计算结束时间时按固定间隔重新计算
+func frozenRequeueAfter(until time.Time) time.Duration {
+	if appv1.IsFrozenIndefinitely(until) {
+		return indefiniteFreezeRequeueAfter
+	}
+	return time.Until(until) + time.Second
+}
+
+// minRequeue 返回大于 0 的最小间隔，都不大于 0 时返回 0
+func minRequeue(durations ...time.Duration) time.Duration {
+	var min time.Duration
+	for _, d := range durations {
+		if d > 0 && (min == 0 || d < min) {
+			min = d
+		}
+	}
+	return min
+}
+
+// isRolloutComplete 判断工作负载是否已经完成发布
+func isRolloutComplete(obj client.Object) bool {
+	ws := getWorkloadStatus(obj)
+	if ws.ObservedGeneration < obj.GetGeneration() {
+		return false
+	}
+	replicas := getReplicas(obj)
+	return ws.UpdatedReplicas == replicas && ws.AvailableReplicas == replicas && ws.Replicas == replicas
+}
+
+// isDeleteProtected 判断是否被 webhook 的删除保护拒绝
+func isDeleteProtected(err error) bool {
+	if !apierrors.IsInvalid(err) {
+		return false
+	}
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) || status.Status().Details == nil {
+		return false
+	}
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Field == appv1.ProtectedFieldPath {
+			return true
+		}
+	}
+	return false
+}
+
+// getRevision 返回镜像的短哈希，作为 hook 的版本标识
+func getRevision(image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return hex.EncodeToString(sum[:])[:10]
+}
+
+// getObjectHash 对象 JSON 的哈希
+func getObjectHash(obj interface{}) (string, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
 	}
-	if strings.Contains(err.Error(), appv1.DeleteProtectedMessage) {
-		return nil
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+func getCronJobName(ac *appv1.AppConfig, bj *appv1.BatchJob) string {
+	return ac.Name + "-" + bj.Name
+}
+
+func getHeadlessSvcName(name string) string {
+	return name + headlessSvcSuffix
+}
+
+// getCanaryRollingWeight 按 canary 可用副本占所有可用副本的比例计算 canary ingress 权重，
+// 结果限制在 min/max 之间，并且相对当前权重每个间隔最多变化 step，返回本次设置的权重和最终的目标权重
+func getCanaryRollingWeight(ac *appv1.AppConfig, current int, lastStep time.Time) (int, int, error) {
+	minWeight, err := getIntAnnotation(ac, appv1.CanaryRollingMinWeightAnnotation, 0)
+	if err != nil {
+		return 0, 0, err
 	}
-	if strings.Contains(err.Error(), appv1.VersionNotLatestMessage) {
-		return nil
+	maxWeight, err := getIntAnnotation(ac, appv1.CanaryRollingMaxWeightAnnotation, 100)
+	if err != nil {
+		return 0, 0, err
 	}
-	return err
+	step, err := getIntAnnotation(ac, appv1.CanaryRollingWeightStepAnnotation, 100)
+	if err != nil {
+		return 0, 0, err
+	}
+	if minWeight < 0 || maxWeight > 100 || minWeight > maxWeight || step <= 0 {
+		return 0, 0, newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("invalid canary rolling weight: min %d, max %d, step %d", minWeight, maxWeight, step))
+	}
+
+	target := minWeight
+	canaryStatus, ok := getDeployStatus(appv1.CanaryDeploy, ac.Status.DeployStatus)
+	if ok && ac.Status.AvailableReplicas > 0 {
+		target = int(math.Round(float64(canaryStatus.AvailableReplicas) * 100 / float64(ac.Status.AvailableReplicas)))
+	}
+	target = clampInt(target, minWeight, maxWeight)
+	clamped := clampInt(current, minWeight, maxWeight)
+	// 距离上次变化不到一个间隔时保持当前权重，ingress 更新触发的调谐不会连续变化
+	if clamped == current && time.Since(lastStep) < canaryWeightStepInterval {
+		return current, target, nil
+	}
+	return clampInt(target, clamped-step, clamped+step), target, nil
 }
 
-func getNamePath(m *metav1.ObjectMeta) string {
-	return m.Namespace + "/" + m.Name
+// getIntAnnotation 读取整数注解，没有设置时返回默认值
+func getIntAnnotation(ac *appv1.AppConfig, k string, def int) (int, error) {
+	v := appv1.GetAnnotation(ac, k)
+	if v == appv1.NilValue {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, newPermanentError(appv1.InvalidConfigReason, fmt.Errorf("invalid %s annotation: %w", k, err))
+	}
+	return i, nil
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
 }
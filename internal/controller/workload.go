@@ -0,0 +1,129 @@
+package controller
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// workloadStatus Deployment 和 StatefulSet 统一的状态
+type workloadStatus struct {
+	ObservedGeneration int64
+	Replicas           int32
+	UpdatedReplicas    int32
+	AvailableReplicas  int32
+	Available          corev1.ConditionStatus
+	Progressing        corev1.ConditionStatus
+}
+
+// podConfig 渲染 pod 模板时依赖的集群状态
+type podConfig struct {
+	// configHash 引用的 ConfigMap/Secret 内容哈希，变化时触发滚动更新
+	configHash string
+	// configFiles 配置文件 ConfigMap 名称和挂载目录，没有配置文件时为空
+	configFiles     string
+	configMountPath string
+}
+
+func newWorkload(kind appv1.WorkloadKind) client.Object {
+	if kind == appv1.StatefulSetWorkload {
+		return &appsv1.StatefulSet{}
+	}
+	return &appsv1.Deployment{}
+}
+
+func getWorkloadKind(obj client.Object) appv1.WorkloadKind {
+	if _, ok := obj.(*appsv1.StatefulSet); ok {
+		return appv1.StatefulSetWorkload
+	}
+	return appv1.DeploymentWorkload
+}
+
+func getPodTemplate(obj client.Object) *corev1.PodTemplateSpec {
+	switch w := obj.(type) {
+	case *appsv1.Deployment:
+		return &w.Spec.Template
+	case *appsv1.StatefulSet:
+		return &w.Spec.Template
+	}
+	return &corev1.PodTemplateSpec{}
+}
+
+// getReplicas 返回期望的副本数，没有设置时默认 1
+func getReplicas(obj client.Object) int32 {
+	var replicas *int32
+	switch w := obj.(type) {
+	case *appsv1.Deployment:
+		replicas = w.Spec.Replicas
+	case *appsv1.StatefulSet:
+		replicas = w.Spec.Replicas
+	}
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+// getWorkloadStatus StatefulSet 没有 Available Progressing 条件，根据副本数推算
+func getWorkloadStatus(obj client.Object) workloadStatus {
+	ws := workloadStatus{
+		Available:   corev1.ConditionUnknown,
+		Progressing: corev1.ConditionUnknown,
+	}
+	switch w := obj.(type) {
+	case *appsv1.Deployment:
+		ws.ObservedGeneration = w.Status.ObservedGeneration
+		ws.Replicas = w.Status.Replicas
+		ws.UpdatedReplicas = w.Status.UpdatedReplicas
+		ws.AvailableReplicas = w.Status.AvailableReplicas
+		if c, ok := getCondition(appsv1.DeploymentAvailable, w.Status.Conditions); ok {
+			ws.Available = c.Status
+		}
+		if c, ok := getCondition(appsv1.DeploymentProgressing, w.Status.Conditions); ok {
+			ws.Progressing = c.Status
+		}
+	case *appsv1.StatefulSet:
+		ws.ObservedGeneration = w.Status.ObservedGeneration
+		ws.Replicas = w.Status.Replicas
+		ws.UpdatedReplicas = w.Status.UpdatedReplicas
+		ws.AvailableReplicas = w.Status.AvailableReplicas
+		if ws.ObservedGeneration > 0 {
+			ws.Progressing = corev1.ConditionTrue
+			ws.Available = corev1.ConditionFalse
+			if ws.AvailableReplicas >= getReplicas(w) {
+				ws.Available = corev1.ConditionTrue
+			}
+		}
+	}
+	return ws
+}
+
+// getJobPodSpec 基于渲染后的 Pod 模板生成 Job 的 Pod，保留 app 容器的环境变量、配置文件、资源和生命周期，以及 serviceAccount imagePullSecrets 等 Pod 配置
+// 只保留 app 容器，避免 sidecar 导致 Job 无法结束，去掉只对常驻服务有意义的健康检查和 StatefulSet 存储卷模板的挂载
+func getJobPodSpec(tmpl *corev1.PodTemplateSpec, restartPolicy corev1.RestartPolicy) corev1.PodSpec {
+	spec := *tmpl.Spec.DeepCopy()
+	spec.RestartPolicy = restartPolicy
+	spec.Containers = nil
+	app, ok := getContainer(appName, tmpl.Spec.Containers)
+	if !ok {
+		return spec
+	}
+	c := *app.DeepCopy()
+	c.LivenessProbe = nil
+	c.ReadinessProbe = nil
+	c.StartupProbe = nil
+	volumes := make(map[string]bool)
+	for _, v := range spec.Volumes {
+		volumes[v.Name] = true
+	}
+	var mounts []corev1.VolumeMount
+	for _, m := range c.VolumeMounts {
+		if volumes[m.Name] {
+			mounts = append(mounts, m)
+		}
+	}
+	c.VolumeMounts = mounts
+	spec.Containers = []corev1.Container{c}
+	return spec
+}
@@ -0,0 +1,558 @@
+package controller
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestUpdateDeployWorkloadKind(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	newAppConfig := func(kind appv1.WorkloadKind) *appv1.AppConfig {
+		ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+		ac.Spec.DeployConfigs = []appv1.DeployConfig{{Name: "demo", Type: appv1.StableDeploy, Image: "app:v1", WorkloadKind: kind}}
+		return ac
+	}
+	owned := func(obj client.Object) client.Object {
+		if err := ctrl.SetControllerReference(newAppConfig(""), obj, s); err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	// 发布完成的旧工作负载
+	dm := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+	dm.Spec.Template.Spec.Containers = []corev1.Container{{Name: appName, Image: "app:v1"}}
+	dm.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+	sts.Spec.Template.Spec.Containers = []corev1.Container{{Name: appName, Image: "app:v1"}}
+	sts.Status = appsv1.StatefulSetStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	headless := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: getHeadlessSvcName("demo"), Namespace: "default"}}
+
+	onDelete := newAppConfig(appv1.StatefulSetWorkload)
+	appv1.AddAnnotation(onDelete, appv1.DeploymentConfigAnnotation, `{"spec":{"updateStrategy":{"type":"OnDelete"}}}`)
+
+	tests := []struct {
+		name         string
+		ac           *appv1.AppConfig
+		objs         []client.Object
+		newKind      client.Object
+		oldKind      client.Object
+		wantHeadless bool
+		wantReason   string
+	}{
+		{
+			name:         "deployment to statefulset",
+			ac:           newAppConfig(appv1.StatefulSetWorkload),
+			objs:         []client.Object{owned(dm.DeepCopy())},
+			newKind:      &appsv1.StatefulSet{},
+			oldKind:      &appsv1.Deployment{},
+			wantHeadless: true,
+		},
+		{
+			name:    "statefulset to deployment",
+			ac:      newAppConfig(appv1.DeploymentWorkload),
+			objs:    []client.Object{owned(sts.DeepCopy()), owned(headless.DeepCopy())},
+			newKind: &appsv1.Deployment{},
+			oldKind: &appsv1.StatefulSet{},
+		},
+		{
+			name:       "statefulset on delete",
+			ac:         onDelete,
+			wantReason: appv1.InvalidConfigReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithScheme(s).WithObjects(append(tt.objs, tt.ac)...)
+			for _, obj := range []client.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}, &batchv1.Job{}, &corev1.ConfigMap{}} {
+				c = c.WithIndex(obj, ownerKey, func(obj client.Object) []string {
+					if owner := metav1.GetControllerOf(obj); owner != nil {
+						return []string{owner.Name}
+					}
+					return nil
+				})
+			}
+			r := &AppConfigReconciler{Client: c.Build(), Scheme: s, Recorder: record.NewFakeRecorder(10)}
+			ctx := context.Background()
+			reconcile := func() error {
+				wlMap, err := r.listWorkload(ctx, tt.ac)
+				if err != nil {
+					return err
+				}
+				_, err = r.updateDeploy(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(tt.ac)}, tt.ac, wlMap)
+				return err
+			}
+			exists := func(obj client.Object, name string) bool {
+				err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, obj)
+				if err != nil && !apierrors.IsNotFound(err) {
+					t.Fatal(err)
+				}
+				return err == nil
+			}
+
+			err := reconcile()
+			if tt.wantReason != "" {
+				if reason, _ := permanentReason(err); reason != tt.wantReason {
+					t.Fatalf("updateDeploy() error = %v, want reason %s", err, tt.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 新的工作负载发布完成前保留旧的
+			if !exists(tt.newKind, "demo") || !exists(tt.oldKind, "demo") {
+				t.Fatal("want both workloads during rollout")
+			}
+			if got := exists(&corev1.Service{}, getHeadlessSvcName("demo")); !got {
+				t.Fatal("headless service deleted during rollout")
+			}
+
+			// 新的工作负载发布完成后删除旧的
+			switch wl := tt.newKind.(type) {
+			case *appsv1.Deployment:
+				wl.Status = dm.Status
+			case *appsv1.StatefulSet:
+				wl.Status = sts.Status
+			}
+			if err := r.Status().Update(ctx, tt.newKind); err != nil {
+				t.Fatal(err)
+			}
+			if err := reconcile(); err != nil {
+				t.Fatal(err)
+			}
+			if exists(tt.oldKind, "demo") {
+				t.Error("old workload not deleted")
+			}
+			if got := exists(&corev1.Service{}, getHeadlessSvcName("demo")); got != tt.wantHeadless {
+				t.Errorf("headless service exists = %v, want %v", got, tt.wantHeadless)
+			}
+		})
+	}
+}
+
+func TestUpdateDeployCanaryIdle(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	newAppConfig := func(canaryImage string) *appv1.AppConfig {
+		ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+		ac.Spec.DeployConfigs = []appv1.DeployConfig{
+			{Name: "demo-stable", Type: appv1.StableDeploy, Image: "app:v1"},
+			{Name: "demo-canary", Type: appv1.CanaryDeploy, Image: canaryImage},
+		}
+		ac.Spec.Ingress.Enable = true
+		ac.Spec.Ingress.Host = "demo.example.com"
+		return ac
+	}
+	owned := func(obj client.Object) client.Object {
+		if err := ctrl.SetControllerReference(newAppConfig("app:v1"), obj, s); err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	// stable 以 app:v1 发布完成
+	stable := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo-stable", Namespace: "default"}}
+	stable.Spec.Replicas = new(int32)
+	*stable.Spec.Replicas = 1
+	stable.Spec.Template.Spec.Containers = []corev1.Container{{Name: appName, Image: "app:v1"}}
+	stable.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	canary := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo-canary", Namespace: "default"}}
+	canary.Spec.Template.Spec.Containers = []corev1.Container{{Name: appName, Image: "app:v1"}}
+	canaryIngress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "demo-canary", Namespace: "default"}}
+
+	optOut := newAppConfig("app:v1")
+	appv1.AddAnnotation(optOut, appv1.CanaryIdleAnnotation, appv1.FalseValue)
+
+	tests := []struct {
+		name         string
+		ac           *appv1.AppConfig
+		wantReplicas int32
+		wantIngress  bool
+		wantIdle     bool
+		// fromIdle canary 已经空闲：缩容到 0 并且没有 ingress
+		fromIdle bool
+	}{
+		{
+			name:     "same image as released stable",
+			ac:       newAppConfig("app:v1"),
+			wantIdle: true,
+		},
+		{
+			name:         "canary image changed",
+			ac:           newAppConfig("app:v2"),
+			fromIdle:     true,
+			wantReplicas: 1,
+			wantIngress:  true,
+		},
+		{
+			name:         "idle disabled",
+			ac:           optOut,
+			wantReplicas: 1,
+			wantIngress:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := []client.Object{tt.ac, owned(stable.DeepCopy())}
+			if tt.fromIdle {
+				idle := canary.DeepCopy()
+				idle.Spec.Replicas = new(int32)
+				objs = append(objs, owned(idle))
+			} else {
+				objs = append(objs, owned(canary.DeepCopy()), owned(canaryIngress.DeepCopy()))
+			}
+			c := fake.NewClientBuilder().WithScheme(s).WithObjects(objs...)
+			for _, obj := range []client.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}, &batchv1.Job{}, &corev1.ConfigMap{}} {
+				c = c.WithIndex(obj, ownerKey, func(obj client.Object) []string {
+					if owner := metav1.GetControllerOf(obj); owner != nil {
+						return []string{owner.Name}
+					}
+					return nil
+				})
+			}
+			r := &AppConfigReconciler{Client: c.Build(), Scheme: s, Recorder: record.NewFakeRecorder(10)}
+			ctx := context.Background()
+			wlMap, err := r.listWorkload(ctx, tt.ac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.updateDeploy(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(tt.ac)}, tt.ac, wlMap); err != nil {
+				t.Fatal(err)
+			}
+
+			dm := &appsv1.Deployment{}
+			if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "demo-canary"}, dm); err != nil {
+				t.Fatal(err)
+			}
+			if got := *dm.Spec.Replicas; got != tt.wantReplicas {
+				t.Errorf("canary replicas = %d, want %d", got, tt.wantReplicas)
+			}
+			err = r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "demo-canary"}, &networkingv1.Ingress{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				t.Fatal(err)
+			}
+			if got := err == nil; got != tt.wantIngress {
+				t.Errorf("canary ingress exists = %v, want %v", got, tt.wantIngress)
+			}
+			if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "demo-stable"}, &networkingv1.Ingress{}); err != nil {
+				t.Errorf("stable ingress: %v", err)
+			}
+			if got := isCanaryIdle(tt.ac, wlMap); got != tt.wantIdle {
+				t.Errorf("isCanaryIdle() = %v, want %v", got, tt.wantIdle)
+			}
+		})
+	}
+}
+
+func TestSortDeployConfigs(t *testing.T) {
+	dcs := []appv1.DeployConfig{
+		{Name: "demo-stable", Type: appv1.StableDeploy},
+		{Name: "demo-canary", Type: appv1.CanaryDeploy},
+	}
+	sorted := sortDeployConfigs(dcs)
+	if len(sorted) != 2 || sorted[0].Name != "demo-canary" || sorted[1].Name != "demo-stable" {
+		t.Errorf("sortDeployConfigs() = %v, want canary before stable", sorted)
+	}
+	if dcs[0].Name != "demo-stable" {
+		t.Error("sortDeployConfigs() modified the spec order")
+	}
+}
+
+func TestIsCanaryReleased(t *testing.T) {
+	ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+	ac.Spec.DeployConfigs = []appv1.DeployConfig{
+		{Name: "demo-stable", Type: appv1.StableDeploy, Image: "app:v2"},
+		{Name: "demo-canary", Type: appv1.CanaryDeploy, Image: "app:v2"},
+	}
+	newCanary := func(image string, updated int32, available corev1.ConditionStatus) *appsv1.Deployment {
+		dm := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo-canary", Namespace: "default"}}
+		dm.Spec.Replicas = new(int32)
+		*dm.Spec.Replicas = 1
+		dm.Spec.Template.Spec.Containers = []corev1.Container{{Name: appName, Image: image}}
+		dm.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: updated, AvailableReplicas: 1}
+		dm.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: available}}
+		return dm
+	}
+
+	tests := []struct {
+		name string
+		wl   client.Object
+		want bool
+	}{
+		{name: "no canary workload"},
+		{name: "old image", wl: newCanary("app:v1", 1, corev1.ConditionTrue)},
+		{name: "rollout not complete", wl: newCanary("app:v2", 0, corev1.ConditionTrue)},
+		{name: "not available", wl: newCanary("app:v2", 1, corev1.ConditionFalse)},
+		{name: "released", wl: newCanary("app:v2", 1, corev1.ConditionTrue), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wlMap := map[string]client.Object{}
+			if tt.wl != nil {
+				wlMap[tt.wl.GetName()] = tt.wl
+			}
+			if got := isCanaryReleased(ac, wlMap); got != tt.want {
+				t.Errorf("isCanaryReleased() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateDeployStrictRelease(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// stable 在 spec 中排在 canary 前面
+	ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+	appv1.AddAnnotation(ac, appv1.StrictReleaseAnnotation, appv1.TureValue)
+	ac.Spec.DeployConfigs = []appv1.DeployConfig{
+		{Name: "demo-stable", Type: appv1.StableDeploy, Image: "app:v2"},
+		{Name: "demo-canary", Type: appv1.CanaryDeploy, Image: "app:v2"},
+	}
+	released := appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1,
+		Conditions: []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionTrue}}}
+	var objs []client.Object
+	for _, name := range []string{"demo-stable", "demo-canary"} {
+		dm := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		dm.Spec.Replicas = new(int32)
+		*dm.Spec.Replicas = 1
+		dm.Spec.Template.Spec.Containers = []corev1.Container{{Name: appName, Image: "app:v1"}}
+		dm.Status = released
+		if name == "demo-canary" {
+			// fake client 不会更新 generation，用未更新的副本表示 canary 的新版本还在发布
+			dm.Status.UpdatedReplicas = 0
+		}
+		if err := ctrl.SetControllerReference(ac, dm, s); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, dm)
+	}
+
+	c := fake.NewClientBuilder().WithScheme(s).WithObjects(append(objs, ac)...)
+	for _, obj := range []client.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}, &batchv1.Job{}, &corev1.ConfigMap{}} {
+		c = c.WithIndex(obj, ownerKey, func(obj client.Object) []string {
+			if owner := metav1.GetControllerOf(obj); owner != nil {
+				return []string{owner.Name}
+			}
+			return nil
+		})
+	}
+	r := &AppConfigReconciler{Client: c.Build(), Scheme: s, Recorder: record.NewFakeRecorder(10)}
+	ctx := context.Background()
+	reconcile := func() bool {
+		wlMap, err := r.listWorkload(ctx, ac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		progressing, err := r.updateDeploy(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ac)}, ac, wlMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return progressing
+	}
+	image := func(name string) string {
+		dm := &appsv1.Deployment{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, dm); err != nil {
+			t.Fatal(err)
+		}
+		return dm.Spec.Template.Spec.Containers[0].Image
+	}
+
+	// canary 在同一轮中先更新，但还没有可用，stable 保持旧镜像
+	if !reconcile() {
+		t.Error("updateDeploy() progressing = false while stable is held")
+	}
+	if got := image("demo-canary"); got != "app:v2" {
+		t.Errorf("canary image = %s, want app:v2", got)
+	}
+	if got := image("demo-stable"); got != "app:v1" {
+		t.Errorf("stable image = %s, want app:v1 until canary is available", got)
+	}
+
+	// canary 可用后更新 stable
+	canary := &appsv1.Deployment{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "demo-canary"}, canary); err != nil {
+		t.Fatal(err)
+	}
+	canary.Status = released
+	if err := r.Status().Update(ctx, canary); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if got := image("demo-stable"); got != "app:v2" {
+		t.Errorf("stable image = %s, want app:v2 after canary is available", got)
+	}
+}
+
+func TestSetAppContainerEnv(t *testing.T) {
+	ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+	dc := &appv1.DeployConfig{Name: "demo", Type: appv1.StableDeploy, Image: "app:v1"}
+	dm := &appsv1.Deployment{}
+	// 全局模板设置的环境变量不由 AppConfig 管理
+	dm.Spec.Template.Spec.Containers = []corev1.Container{{Name: appName, Env: []corev1.EnvVar{{Name: "TEMPLATE", Value: "true"}}}}
+	r := &AppConfigReconciler{}
+
+	ac.Spec.Env = []corev1.EnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "2"}}
+	ac.Spec.EnvFrom = []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "a"}}},
+		{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "b"}}},
+	}
+	r.setAppContainer(dm, &dm.Spec.Template, ac, dc)
+
+	tests := []struct {
+		name        string
+		env         []corev1.EnvVar
+		envFrom     []corev1.EnvFromSource
+		wantEnv     []string
+		wantEnvFrom []string
+	}{
+		{
+			name:        "remove env",
+			env:         []corev1.EnvVar{{Name: "B", Value: "3"}},
+			envFrom:     ac.Spec.EnvFrom,
+			wantEnv:     []string{"TEMPLATE", "B"},
+			wantEnvFrom: []string{"ConfigMap/a/", "Secret/b/"},
+		},
+		{
+			name:        "remove envFrom",
+			env:         []corev1.EnvVar{{Name: "B", Value: "3"}},
+			envFrom:     ac.Spec.EnvFrom[1:],
+			wantEnv:     []string{"TEMPLATE", "B"},
+			wantEnvFrom: []string{"Secret/b/"},
+		},
+		{
+			name:    "remove all",
+			wantEnv: []string{"TEMPLATE"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac.Spec.Env = tt.env
+			ac.Spec.EnvFrom = tt.envFrom
+			r.setAppContainer(dm, &dm.Spec.Template, ac, dc)
+			c := dm.Spec.Template.Spec.Containers[0]
+			var env, envFrom []string
+			for _, e := range c.Env {
+				env = append(env, e.Name)
+			}
+			for _, e := range c.EnvFrom {
+				envFrom = append(envFrom, getEnvFromKey(e))
+			}
+			if !reflect.DeepEqual(env, tt.wantEnv) {
+				t.Errorf("env = %v, want %v", env, tt.wantEnv)
+			}
+			if !reflect.DeepEqual(envFrom, tt.wantEnvFrom) {
+				t.Errorf("envFrom = %v, want %v", envFrom, tt.wantEnvFrom)
+			}
+			if len(tt.env) == 0 && len(tt.envFrom) == 0 && appv1.GetAnnotation(dm, appv1.ManagedEnvAnnotation) != appv1.NilValue {
+				t.Errorf("managed env annotation should be removed")
+			}
+		})
+	}
+}
+
+func TestSetDeploymentContainerConfig(t *testing.T) {
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	r := &AppConfigReconciler{Scheme: s}
+	dc := &appv1.DeployConfig{Name: "demo", Type: appv1.StableDeploy, Image: "app:v1"}
+	probe := &corev1.Probe{ProbeHandler: corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(80)}}}
+	// 上一次调谐时 spec 设置的配置
+	live := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+	live.Spec.Template.Spec.Containers = []corev1.Container{{
+		Name:           appName,
+		LivenessProbe:  probe,
+		ReadinessProbe: probe,
+		Lifecycle:      &corev1.Lifecycle{PreStop: &corev1.LifecycleHandler{Exec: &corev1.ExecAction{Command: []string{"sleep", "5"}}}},
+		Resources:      corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}},
+	}}
+
+	tests := []struct {
+		name          string
+		annotation    string
+		readiness     *corev1.Probe
+		wantLiveness  bool
+		wantReadiness bool
+		wantCPU       string
+	}{
+		{
+			name: "removed from spec",
+		},
+		{
+			name:          "spec and annotation",
+			annotation:    `{"spec":{"template":{"spec":{"containers":[{"name":"app","livenessProbe":{"tcpSocket":{"port":80}},"resources":{"limits":{"cpu":"2"}}}]}}}}`,
+			readiness:     probe,
+			wantLiveness:  true,
+			wantReadiness: true,
+			wantCPU:       "2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo"}}
+			ac.Spec.ReadinessProbe = tt.readiness
+			if tt.annotation != "" {
+				appv1.AddAnnotation(ac, appv1.DeploymentConfigAnnotation, tt.annotation)
+			}
+			dm := live.DeepCopy()
+			if err := r.setDeployment(dm, ac, dc, &podConfig{})(); err != nil {
+				t.Fatal(err)
+			}
+			c, _ := getContainer(appName, dm.Spec.Template.Spec.Containers)
+			if (c.LivenessProbe != nil) != tt.wantLiveness {
+				t.Errorf("livenessProbe = %v, want %v", c.LivenessProbe, tt.wantLiveness)
+			}
+			if (c.ReadinessProbe != nil) != tt.wantReadiness {
+				t.Errorf("readinessProbe = %v, want %v", c.ReadinessProbe, tt.wantReadiness)
+			}
+			if c.Lifecycle != nil {
+				t.Errorf("lifecycle = %v, want nil", c.Lifecycle)
+			}
+			cpu := ""
+			if q, ok := c.Resources.Limits[corev1.ResourceCPU]; ok {
+				cpu = q.String()
+			}
+			if cpu != tt.wantCPU {
+				t.Errorf("cpu limit = %q, want %q", cpu, tt.wantCPU)
+			}
+		})
+	}
+}
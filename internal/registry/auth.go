@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	appv1 "sanmuyan.com/app-operator/api/v1"
+)
+
+// ErrUnauthorized 使用当前凭证仍然没有拉取权限
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Credential 仓库的用户名和密码，为空时匿名访问
+type Credential struct {
+	Username string
+	Password string
+}
+
+// basicAuth 返回 Basic 认证的 Authorization 头
+func (c *Credential) basicAuth() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+}
+
+// cacheKey 区分不同凭证获取的 token，匿名时为空
+func (c *Credential) cacheKey() string {
+	if c == nil {
+		return ""
+	}
+	h := sha256.Sum256([]byte(c.Username + ":" + c.Password))
+	return hex.EncodeToString(h[:8])
+}
+
+// dockerConfigEntry dockerconfigjson 中一个仓库的认证信息
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// FindCredential 从 kubernetes.io/dockerconfigjson 或 kubernetes.io/dockercfg 格式的数据中查找仓库的凭证，没有找到时返回 nil
+func FindCredential(data []byte, registry string) (*Credential, error) {
+	config := struct {
+		Auths map[string]dockerConfigEntry `json:"auths"`
+	}{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	auths := config.Auths
+	if auths == nil {
+		// dockercfg 没有 auths 这一层
+		if err := json.Unmarshal(data, &auths); err != nil {
+			return nil, err
+		}
+	}
+	for server, entry := range auths {
+		if normalizeRegistry(server) != registry {
+			continue
+		}
+		cred := &Credential{Username: entry.Username, Password: entry.Password}
+		if entry.Auth != appv1.NilValue {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for %s: %w", server, err)
+			}
+			var ok bool
+			cred.Username, cred.Password, ok = strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth for %s", server)
+			}
+		}
+		return cred, nil
+	}
+	return nil, nil
+}
+
+// normalizeRegistry 去掉 dockerconfig 中仓库地址的协议和路径，Docker Hub 的各种地址统一为 docker.io
+func normalizeRegistry(server string) string {
+	host := server
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return appv1.DefaultRegistry
+	}
+	return host
+}
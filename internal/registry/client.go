@@ -0,0 +1,269 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	appv1 "sanmuyan.com/app-operator/api/v1"
+)
+
+// ErrNotFound 镜像或仓库不存在
+var ErrNotFound = errors.New("image not found")
+
+// manifestAccept 解析 digest 时接受的 manifest 类型，多架构镜像返回 index 的 digest
+var manifestAccept = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+// Client OCI distribution API 客户端，支持匿名和 imagePullSecrets 中的凭证
+type Client struct {
+	HTTPClient *http.Client
+	// PlainHTTP 使用 http 访问的仓库，localhost 和 127.0.0.1 总是使用 http
+	PlainHTTP []string
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func NewClient(plainHTTP []string) *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		PlainHTTP:  plainHTTP,
+		tokens:     make(map[string]string),
+	}
+}
+
+// ResolveDigest 获取镜像 tag 对应的 manifest digest，cred 为空时匿名访问
+func (c *Client) ResolveDigest(ctx context.Context, ref appv1.ImageRef, cred *Credential) (string, error) {
+	if ref.Digest != appv1.NilValue {
+		return ref.Digest, nil
+	}
+	resp, err := c.do(ctx, http.MethodHead, ref, cred, "/manifests/"+ref.Tag, manifestAccept)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == appv1.NilValue {
+		return "", fmt.Errorf("registry %s did not return a digest for %s", ref.Registry, ref.String())
+	}
+	return digest, nil
+}
+
+// ListTags 获取镜像仓库的 tag 列表，cred 为空时匿名访问
+func (c *Client) ListTags(ctx context.Context, ref appv1.ImageRef, cred *Credential) ([]string, error) {
+	var tags []string
+	path := "/tags/list"
+	for path != appv1.NilValue {
+		resp, err := c.do(ctx, http.MethodGet, ref, cred, path, "application/json")
+		if err != nil {
+			return nil, err
+		}
+		body := struct {
+			Tags []string `json:"tags"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, body.Tags...)
+		path = nextPath(resp.Header.Get("Link"), ref.Repository)
+	}
+	return tags, nil
+}
+
+func (c *Client) do(ctx context.Context, method string, ref appv1.ImageRef, cred *Credential, path, accept string) (*http.Response, error) {
+	u := c.baseURL(ref.Registry) + "/v2/" + ref.Repository + path
+	resp, err := c.request(ctx, method, u, accept, c.authorization(ref, cred))
+	if err != nil {
+		return nil, err
+	}
+	// 需要认证时按照挑战获取 token 或使用 Basic 认证后重试一次
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		authorization, err := c.authorize(ctx, challenge, ref, cred)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = c.request(ctx, method, u, accept, authorization)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: registry %s returned %s for %s", ErrUnauthorized, ref.Registry, resp.Status, ref.String())
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref.String())
+	case resp.StatusCode >= http.StatusBadRequest:
+		resp.Body.Close()
+		return nil, fmt.Errorf("registry %s returned %s for %s", ref.Registry, resp.Status, u)
+	}
+	return resp, nil
+}
+
+func (c *Client) request(ctx context.Context, method, u, accept, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if authorization != appv1.NilValue {
+		req.Header.Set("Authorization", authorization)
+	}
+	return c.HTTPClient.Do(req)
+}
+
+// authorization 返回缓存的 Authorization 头，没有缓存时为空
+func (c *Client) authorization(ref appv1.ImageRef, cred *Credential) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[tokenKey(ref, cred)]
+}
+
+// authorize 按照 WWW-Authenticate 挑战生成 Authorization 头并缓存
+// Bearer 挑战时获取 token，有凭证时使用 Basic 认证请求 token 服务，Basic 挑战时直接使用凭证
+func (c *Client) authorize(ctx context.Context, challenge string, ref appv1.ImageRef, cred *Credential) (string, error) {
+	var authorization string
+	scheme, _, _ := strings.Cut(challenge, " ")
+	switch {
+	case strings.EqualFold(scheme, "bearer"):
+		token, err := c.fetchToken(ctx, challenge, ref, cred)
+		if err != nil {
+			return "", err
+		}
+		authorization = "Bearer " + token
+	case strings.EqualFold(scheme, "basic") && cred != nil:
+		authorization = cred.basicAuth()
+	case strings.EqualFold(scheme, "basic"):
+		return "", fmt.Errorf("%w: registry %s requires credentials for %s", ErrUnauthorized, ref.Registry, ref.String())
+	default:
+		return "", fmt.Errorf("registry %s requires unsupported authentication: %s", ref.Registry, challenge)
+	}
+	c.mu.Lock()
+	c.tokens[tokenKey(ref, cred)] = authorization
+	c.mu.Unlock()
+	return authorization, nil
+}
+
+// fetchToken 按照 WWW-Authenticate 的 Bearer 挑战获取 token，cred 为空时获取匿名 token
+func (c *Client) fetchToken(ctx context.Context, challenge string, ref appv1.ImageRef, cred *Credential) (string, error) {
+	params := parseChallenge(challenge)
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("registry %s requires unsupported authentication: %s", ref.Registry, challenge)
+	}
+	q := url.Values{}
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	q.Set("scope", "repository:"+ref.Repository+":pull")
+	authorization := ""
+	if cred != nil {
+		authorization = cred.basicAuth()
+	}
+	resp, err := c.request(ctx, http.MethodGet, realm+"?"+q.Encode(), "application/json", authorization)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return "", fmt.Errorf("%w: failed to get token from %s: %s", ErrUnauthorized, realm, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("failed to get token from %s: %s", realm, resp.Status)
+	}
+	body := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	token := body.Token
+	if token == appv1.NilValue {
+		token = body.AccessToken
+	}
+	return token, nil
+}
+
+// tokenKey 不同凭证获取的 token 分开缓存，避免匿名请求使用其他凭证的权限
+func tokenKey(ref appv1.ImageRef, cred *Credential) string {
+	return ref.Registry + "/" + ref.Repository + "#" + cred.cacheKey()
+}
+
+func (c *Client) baseURL(registry string) string {
+	host := registry
+	if host == appv1.DefaultRegistry {
+		host = "registry-1.docker.io"
+	}
+	scheme := "https"
+	if isLoopback(host) {
+		scheme = "http"
+	}
+	for _, h := range c.PlainHTTP {
+		if h == registry {
+			scheme = "http"
+		}
+	}
+	return scheme + "://" + host
+}
+
+// isLoopback 判断仓库地址（可以带端口）的主机名是否是 localhost 或回环地址
+func isLoopback(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseChallenge 解析 Bearer realm="...",service="...",scope="..."
+func parseChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return params
+	}
+	for _, part := range strings.Split(challenge[len("bearer "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+// nextPath 解析分页的 Link 头，返回下一页相对 /v2/<repository> 的路径
+func nextPath(link, repository string) string {
+	if link == appv1.NilValue {
+		return ""
+	}
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	u, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(u.Path, "/v2/"+repository) + "?" + u.RawQuery
+}
@@ -0,0 +1,269 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	appv1 "sanmuyan.com/app-operator/api/v1"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// newTestRegistry 启动一个需要 Bearer token 的本地仓库
+func newTestRegistry(t *testing.T) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.URL.Query().Get("scope") != "repository:team/app:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token":"test-token"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/v1.0.0":
+			if !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+				w.WriteHeader(http.StatusNotAcceptable)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", testDigest)
+		case "/v2/team/app/tags/list":
+			// 分两页返回
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", `</v2/team/app/tags/list?n=2&last=v1.0.0>; rel="next"`)
+				_, _ = w.Write([]byte(`{"name":"team/app","tags":["latest","v1.0.0"]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"name":"team/app","tags":["v1.1.0"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolveDigest(t *testing.T) {
+	srv := newTestRegistry(t)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	c := NewClient(nil)
+
+	tests := []struct {
+		name    string
+		image   string
+		want    string
+		wantErr error
+	}{
+		{name: "tag", image: host + "/team/app:v1.0.0", want: testDigest},
+		{name: "digest", image: host + "/team/app@" + testDigest, want: testDigest},
+		{name: "unknown tag", image: host + "/team/app:v2.0.0", wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.ResolveDigest(context.Background(), appv1.ParseImage(tt.image), nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ResolveDigest() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveDigest() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveDigest() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListTags(t *testing.T) {
+	srv := newTestRegistry(t)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	c := NewClient(nil)
+
+	tags, err := c.ListTags(context.Background(), appv1.ParseImage(host+"/team/app:v1.0.0"), nil)
+	if err != nil {
+		t.Fatalf("ListTags() error = %v", err)
+	}
+	if got := strings.Join(tags, ","); got != "latest,v1.0.0,v1.1.0" {
+		t.Errorf("ListTags() = %s, want latest,v1.0.0,v1.1.0", got)
+	}
+}
+
+// newPrivateRegistry 启动一个私有仓库，bearer 为 true 时 token 服务使用 Basic 认证，否则仓库直接使用 Basic 认证
+func newPrivateRegistry(t *testing.T, bearer bool) *httptest.Server {
+	t.Helper()
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.Header.Get("Authorization") != basic {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"private-token"}`))
+			return
+		}
+		want := basic
+		if bearer {
+			want = "Bearer private-token"
+		}
+		if r.Header.Get("Authorization") != want {
+			if bearer {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v2/team/app/manifests/v1.0.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", testDigest)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolveDigestWithCredential(t *testing.T) {
+	tests := []struct {
+		name    string
+		bearer  bool
+		cred    *Credential
+		wantErr error
+	}{
+		{name: "bearer", bearer: true, cred: &Credential{Username: "alice", Password: "secret"}},
+		{name: "basic", cred: &Credential{Username: "alice", Password: "secret"}},
+		{name: "bearer anonymous", bearer: true, wantErr: ErrUnauthorized},
+		{name: "basic anonymous", wantErr: ErrUnauthorized},
+		{name: "bearer wrong password", bearer: true, cred: &Credential{Username: "alice", Password: "wrong"}, wantErr: ErrUnauthorized},
+		{name: "basic wrong password", cred: &Credential{Username: "alice", Password: "wrong"}, wantErr: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newPrivateRegistry(t, tt.bearer)
+			ref := appv1.ParseImage(strings.TrimPrefix(srv.URL, "http://") + "/team/app:v1.0.0")
+			c := NewClient(nil)
+			got, err := c.ResolveDigest(context.Background(), ref, tt.cred)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ResolveDigest() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveDigest() error = %v", err)
+			}
+			if got != testDigest {
+				t.Errorf("ResolveDigest() = %s, want %s", got, testDigest)
+			}
+			// 其他凭证不能使用缓存的 token
+			if _, err := c.ResolveDigest(context.Background(), ref, nil); !errors.Is(err, ErrUnauthorized) {
+				t.Errorf("anonymous ResolveDigest() error = %v, want %v", err, ErrUnauthorized)
+			}
+		})
+	}
+}
+
+func TestFindCredential(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("bob:token"))
+	tests := []struct {
+		name     string
+		data     string
+		registry string
+		want     *Credential
+		wantErr  bool
+	}{
+		{
+			name:     "dockerconfigjson",
+			data:     `{"auths":{"registry.example.com":{"username":"alice","password":"secret"}}}`,
+			registry: "registry.example.com",
+			want:     &Credential{Username: "alice", Password: "secret"},
+		},
+		{
+			name:     "auth field with scheme",
+			data:     `{"auths":{"https://registry.example.com/v2/":{"auth":"` + auth + `"}}}`,
+			registry: "registry.example.com",
+			want:     &Credential{Username: "bob", Password: "token"},
+		},
+		{
+			name:     "docker hub",
+			data:     `{"auths":{"https://index.docker.io/v1/":{"auth":"` + auth + `"}}}`,
+			registry: appv1.DefaultRegistry,
+			want:     &Credential{Username: "bob", Password: "token"},
+		},
+		{
+			name:     "dockercfg",
+			data:     `{"registry.example.com":{"auth":"` + auth + `"}}`,
+			registry: "registry.example.com",
+			want:     &Credential{Username: "bob", Password: "token"},
+		},
+		{
+			name:     "other registry",
+			data:     `{"auths":{"registry.example.com":{"username":"alice","password":"secret"}}}`,
+			registry: "other.example.com",
+		},
+		{
+			name:     "invalid auth",
+			data:     `{"auths":{"registry.example.com":{"auth":"bm8tY29sb24="}}}`,
+			registry: "registry.example.com",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid json",
+			data:     `{`,
+			registry: "registry.example.com",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindCredential([]byte(tt.data), tt.registry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FindCredential() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("FindCredential() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	c := NewClient([]string{"registry.internal:5000"})
+	tests := []struct {
+		registry string
+		want     string
+	}{
+		{registry: appv1.DefaultRegistry, want: "https://registry-1.docker.io"},
+		{registry: "localhost:5000", want: "http://localhost:5000"},
+		{registry: "localhost", want: "http://localhost"},
+		{registry: "127.0.0.1:5000", want: "http://127.0.0.1:5000"},
+		{registry: "[::1]:5000", want: "http://[::1]:5000"},
+		{registry: "registry.internal:5000", want: "http://registry.internal:5000"},
+		{registry: "localhost.example.com", want: "https://localhost.example.com"},
+		{registry: "127.0.0.1.example.com:5000", want: "https://127.0.0.1.example.com:5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			if got := c.baseURL(tt.registry); got != tt.want {
+				t.Errorf("baseURL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sanmuyan.com/app-operator/internal/controller"
+)
+
+//+kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+var serverLog = log.Log.WithName("api-server")
+
+const (
+	// apiPrefix API 路径前缀，后面是 namespaces/<namespace>/appconfigs/<name>/<子资源>
+	apiPrefix = "/apis/v1/"
+	// maxBodySize 请求体的最大长度
+	maxBodySize = 3 << 20
+)
+
+// DryRunner 模拟调谐 AppConfig，不修改任何资源
+type DryRunner interface {
+	DryRun(ctx context.Context, ac *appv1.AppConfig) (*controller.DryRunResult, error)
+}
+
+// Server operator 的 HTTP API，提供发布操作和 dryrun 接口，使用请求的 Bearer token 通过 TokenReview 认证，SubjectAccessReview 鉴权
+type Server struct {
+	Client client.Client
+	// BindAddress 监听地址
+	BindAddress string
+	// CertDir 包含 tls.crt tls.key 的目录，请求中带有 Bearer token，必须使用 TLS
+	CertDir string
+	// DryRunner 为空时不提供 dryrun 接口
+	DryRunner DryRunner
+}
+
+// request 认证后的请求
+type request struct {
+	*http.Request
+	user      authenticationv1.UserInfo
+	namespace string
+	name      string
+	// subresource appconfigs/<name> 之后的路径
+	subresource []string
+}
+
+// NeedLeaderElection 所有副本都提供 API
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Start 启动 HTTPS 服务，直到 ctx 结束，没有配置证书时拒绝启动
+func (s *Server) Start(ctx context.Context) error {
+	if s.CertDir == "" {
+		return errors.New("api server requires TLS, cert dir is empty")
+	}
+	srv := &http.Server{
+		Addr:              s.BindAddress,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		serverLog.Info("starting api server", "address", s.BindAddress, "certDir", s.CertDir)
+		err := srv.ListenAndServeTLS(filepath.Join(s.CertDir, "tls.crt"), filepath.Join(s.CertDir, "tls.key"))
+		if !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	case err := <-errCh:
+		return err
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	namespace, name, subresource, ok := parsePath(r.URL.Path)
+	if !ok {
+		writeError(w, apierrors.NewNotFound(appv1.GroupVersion.WithResource("appconfigs").GroupResource(), r.URL.Path))
+		return
+	}
+	user, err := s.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	req := &request{Request: r, user: user, namespace: namespace, name: name, subresource: subresource}
+	switch {
+	case len(subresource) == 2 && subresource[0] == "actions":
+		s.handleAction(w, req)
+	case len(subresource) == 1 && subresource[0] == "dryrun" && s.DryRunner != nil:
+		s.handleDryRun(w, req)
+	default:
+		writeError(w, apierrors.NewNotFound(appv1.GroupVersion.WithResource("appconfigs").GroupResource(), r.URL.Path))
+	}
+}
+
+// handleAction POST namespaces/<namespace>/appconfigs/<name>/actions/<action>
+// 设置 action 和 action-by 注解，由 controller 执行并记录
+func (s *Server) handleAction(w http.ResponseWriter, req *request) {
+	if req.Method != http.MethodPost {
+		writeError(w, apierrors.NewMethodNotSupported(appv1.GroupVersion.WithResource("appconfigs").GroupResource(), req.Method))
+		return
+	}
+	action := appv1.Action(req.subresource[1])
+	if !action.IsValid() {
+		writeError(w, apierrors.NewBadRequest(fmt.Sprintf("unsupported action %q", action)))
+		return
+	}
+	if err := s.authorize(req, "update"); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ac := &appv1.AppConfig{}
+	if err := s.Client.Get(req.Context(), client.ObjectKey{Namespace: req.namespace, Name: req.name}, ac); err != nil {
+		writeError(w, err)
+		return
+	}
+	patch := client.MergeFromWithOptions(ac.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	appv1.AddAnnotation(ac, appv1.ActionAnnotation, string(action))
+	appv1.AddAnnotation(ac, appv1.ActionByAnnotation, req.user.Username)
+	if err := s.Client.Patch(req.Context(), ac, patch); err != nil {
+		writeError(w, err)
+		return
+	}
+	serverLog.Info("action requested", "namespace", req.namespace, "name", req.name, "action", action, "user", req.user.Username)
+	writeJSON(w, http.StatusAccepted, appv1.ActionRecord{
+		Action: action,
+		User:   req.user.Username,
+		Time:   metav1.Now().Rfc3339Copy(),
+	})
+}
+
+// handleDryRun POST namespaces/<namespace>/appconfigs/<name>/dryrun
+// 请求体是 JSON 或 YAML 格式的 AppConfig，返回使用当前模板和集群状态渲染后的变更以及阻止更新的条件
+func (s *Server) handleDryRun(w http.ResponseWriter, req *request) {
+	if req.Method != http.MethodPost {
+		writeError(w, apierrors.NewMethodNotSupported(appv1.GroupVersion.WithResource("appconfigs").GroupResource(), req.Method))
+		return
+	}
+	// AppConfig 不存在时按创建鉴权
+	verb := "update"
+	live := &appv1.AppConfig{}
+	if err := s.Client.Get(req.Context(), client.ObjectKey{Namespace: req.namespace, Name: req.name}, live); apierrors.IsNotFound(err) {
+		verb = "create"
+	} else if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.authorize(req, verb); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ac := &appv1.AppConfig{}
+	if err := utilyaml.NewYAMLOrJSONDecoder(http.MaxBytesReader(w, req.Body, maxBodySize), 4096).Decode(ac); err != nil {
+		writeError(w, apierrors.NewBadRequest("invalid appConfig: "+err.Error()))
+		return
+	}
+	if (ac.Namespace != "" && ac.Namespace != req.namespace) || (ac.Name != "" && ac.Name != req.name) {
+		writeError(w, apierrors.NewBadRequest(fmt.Sprintf("appConfig %s/%s does not match the request path", ac.Namespace, ac.Name)))
+		return
+	}
+	ac.Namespace = req.namespace
+	ac.Name = req.name
+	// 和 webhook 相同的默认值和校验
+	ac.Default()
+	if _, err := ac.ValidateCreate(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result, err := s.DryRunner.DryRun(req.Context(), ac)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	serverLog.V(1).Info("dry run", "namespace", req.namespace, "name", req.name, "user", req.user.Username,
+		"changes", len(result.Changes), "blocked", len(result.Blocked))
+	writeJSON(w, http.StatusOK, result)
+}
+
+// authenticate 使用 TokenReview 校验 Bearer token
+func (s *Server) authenticate(r *http.Request) (authenticationv1.UserInfo, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return authenticationv1.UserInfo{}, apierrors.NewUnauthorized("bearer token is required")
+	}
+	tr := &authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token}}
+	if err := s.Client.Create(r.Context(), tr); err != nil {
+		return authenticationv1.UserInfo{}, err
+	}
+	if !tr.Status.Authenticated {
+		return authenticationv1.UserInfo{}, apierrors.NewUnauthorized("invalid bearer token")
+	}
+	return tr.Status.User, nil
+}
+
+// authorize 使用 SubjectAccessReview 校验用户对 AppConfig 的权限
+func (s *Server) authorize(req *request, verb string) error {
+	extra := make(map[string]authorizationv1.ExtraValue, len(req.user.Extra))
+	for k, v := range req.user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	sar := &authorizationv1.SubjectAccessReview{Spec: authorizationv1.SubjectAccessReviewSpec{
+		ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Namespace: req.namespace,
+			Verb:      verb,
+			Group:     appv1.GroupVersion.Group,
+			Resource:  "appconfigs",
+			Name:      req.name,
+		},
+		User:   req.user.Username,
+		Groups: req.user.Groups,
+		Extra:  extra,
+		UID:    req.user.UID,
+	}}
+	if err := s.Client.Create(req.Context(), sar); err != nil {
+		return err
+	}
+	if !sar.Status.Allowed {
+		return apierrors.NewForbidden(appv1.GroupVersion.WithResource("appconfigs").GroupResource(), req.name,
+			fmt.Errorf("user %q cannot %s appconfigs in namespace %q", req.user.Username, verb, req.namespace))
+	}
+	return nil
+}
+
+// parsePath 解析 /apis/v1/namespaces/<namespace>/appconfigs/<name>/<子资源>
+func parsePath(path string) (namespace, name string, subresource []string, ok bool) {
+	rest, found := strings.CutPrefix(path, apiPrefix)
+	if !found {
+		return "", "", nil, false
+	}
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	if len(parts) < 4 || parts[0] != "namespaces" || parts[2] != "appconfigs" || parts[1] == "" || parts[3] == "" {
+		return "", "", nil, false
+	}
+	return parts[1], parts[3], parts[4:], true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		serverLog.Error(err, "failed to write response")
+	}
+}
+
+// writeError 以 metav1.Status 返回错误，非 API 错误返回 500
+func writeError(w http.ResponseWriter, err error) {
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) {
+		status = apierrors.NewInternalError(err)
+	}
+	writeJSON(w, int(status.Status().Code), status.Status())
+}
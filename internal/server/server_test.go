@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	appv1 "sanmuyan.com/app-operator/api/v1"
+	"sanmuyan.com/app-operator/internal/controller"
+)
+
+// newTestServer token 为 valid 的用户 alice 只有 default 命名空间的权限
+func newTestServer(t *testing.T) (*Server, client.Client) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := appv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	ac := &appv1.AppConfig{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(ac).WithInterceptorFuncs(interceptor.Funcs{
+		Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			switch o := obj.(type) {
+			case *authenticationv1.TokenReview:
+				if o.Spec.Token == "valid" {
+					o.Status.Authenticated = true
+					o.Status.User = authenticationv1.UserInfo{Username: "alice"}
+				}
+				return nil
+			case *authorizationv1.SubjectAccessReview:
+				o.Status.Allowed = o.Spec.User == "alice" && o.Spec.ResourceAttributes.Namespace == "default"
+				return nil
+			}
+			return c.Create(ctx, obj, opts...)
+		},
+	}).Build()
+	return &Server{Client: c}, c
+}
+
+func TestServerAction(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantCode   int
+		wantAction string
+	}{
+		{name: "missing token", method: http.MethodPost, path: "/apis/v1/namespaces/default/appconfigs/demo/actions/promote", wantCode: http.StatusUnauthorized},
+		{name: "invalid token", method: http.MethodPost, path: "/apis/v1/namespaces/default/appconfigs/demo/actions/promote", token: "invalid", wantCode: http.StatusUnauthorized},
+		{name: "forbidden namespace", method: http.MethodPost, path: "/apis/v1/namespaces/other/appconfigs/demo/actions/promote", token: "valid", wantCode: http.StatusForbidden},
+		{name: "unknown path", method: http.MethodPost, path: "/apis/v1/namespaces/default/demo", token: "valid", wantCode: http.StatusNotFound},
+		{name: "unsupported action", method: http.MethodPost, path: "/apis/v1/namespaces/default/appconfigs/demo/actions/rollback", token: "valid", wantCode: http.StatusBadRequest},
+		{name: "wrong method", method: http.MethodGet, path: "/apis/v1/namespaces/default/appconfigs/demo/actions/promote", token: "valid", wantCode: http.StatusMethodNotAllowed},
+		{name: "missing appconfig", method: http.MethodPost, path: "/apis/v1/namespaces/default/appconfigs/missing/actions/promote", token: "valid", wantCode: http.StatusNotFound},
+		{name: "promote", method: http.MethodPost, path: "/apis/v1/namespaces/default/appconfigs/demo/actions/promote", token: "valid", wantCode: http.StatusAccepted, wantAction: "promote"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, c := newTestServer(t)
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			ac := &appv1.AppConfig{}
+			if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "demo"}, ac); err != nil {
+				t.Fatal(err)
+			}
+			if action := appv1.GetAnnotation(ac, appv1.ActionAnnotation); action != tt.wantAction {
+				t.Errorf("action = %q, want %q", action, tt.wantAction)
+			}
+			if tt.wantAction != "" && appv1.GetAnnotation(ac, appv1.ActionByAnnotation) != "alice" {
+				t.Errorf("action-by = %q, want alice", appv1.GetAnnotation(ac, appv1.ActionByAnnotation))
+			}
+		})
+	}
+}
+
+// stubDryRunner 返回 AppConfig 中 deployConfig 的名称，用于检查默认值
+type stubDryRunner struct{}
+
+func (stubDryRunner) DryRun(_ context.Context, ac *appv1.AppConfig) (*controller.DryRunResult, error) {
+	result := &controller.DryRunResult{}
+	for _, dc := range ac.Spec.DeployConfigs {
+		result.Changes = append(result.Changes, controller.ResourceChange{Kind: "Deployment", Name: dc.Name, Operation: controller.CreateChange})
+	}
+	return result, nil
+}
+
+func TestServerDryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "yaml body",
+			path:     "/apis/v1/namespaces/default/appconfigs/demo/dryrun",
+			body:     "spec:\n  deployConfigs:\n  - type: stable\n    image: app:v2\n",
+			wantCode: http.StatusOK,
+			wantBody: `"name":"demo-stable"`,
+		},
+		{
+			name:     "new appconfig",
+			path:     "/apis/v1/namespaces/default/appconfigs/new/dryrun",
+			body:     `{"spec":{"deployConfigs":[{"type":"canary","image":"app:v2"}]}}`,
+			wantCode: http.StatusOK,
+			wantBody: `"name":"new-canary"`,
+		},
+		{
+			name:     "name mismatch",
+			path:     "/apis/v1/namespaces/default/appconfigs/demo/dryrun",
+			body:     `{"metadata":{"name":"other"}}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid spec",
+			path:     "/apis/v1/namespaces/default/appconfigs/demo/dryrun",
+			body:     `{"spec":{"deployConfigs":[{"type":"blue","image":"app:v2"}]}}`,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "forbidden namespace",
+			path:     "/apis/v1/namespaces/other/appconfigs/demo/dryrun",
+			body:     `{}`,
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			s.DryRunner = stubDryRunner{}
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer valid")
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body does not contain %s: %s", tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestServerStartRequiresTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		certDir string
+	}{
+		{name: "empty cert dir"},
+		{name: "missing certificate", certDir: t.TempDir()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{BindAddress: "127.0.0.1:0", CertDir: tt.certDir}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := s.Start(ctx); err == nil {
+				t.Fatal("Start() should fail without a certificate")
+			}
+		})
+	}
+}